@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/dropbox"
+)
+
+// runDropboxSync runs `dropbox sync [-json]`.
+func runDropboxSync(ctx context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "dropbox-sync")
+	fs := flag.NewFlagSet("dropbox sync", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	_ = fs.Parse(args)
+
+	results, err := dropbox.SyncAll(ctx, cnf)
+	if err != nil {
+		logger.Error("failed to sync", "error", err)
+		return 1
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if *asJSON {
+		if err := printJSON(results); err != nil {
+			logger.Error("failed to print results", "error", err)
+			return 1
+		}
+	} else {
+		fmt.Printf("uploaded %d files, %d failed\n", len(results)-failed, failed)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/feed"
+)
+
+// runFeedBuild runs `feed build [-o path] [-json]`.
+func runFeedBuild(_ context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "feed-build")
+	fs := flag.NewFlagSet("feed build", flag.ExitOnError)
+	outPath := fs.String("o", "", "write the feed into this file instead of stdout")
+	asJSON := fs.Bool("json", false, "print items of the feed as JSON instead of RSS")
+	_ = fs.Parse(args)
+
+	rss, err := feed.Build(cnf.OutDirPath, cnf.Feed.BaseURL)
+	if err != nil {
+		logger.Error("failed to build feed", "error", err)
+		return 1
+	}
+	if *asJSON {
+		err = printJSON(rss.Channel.Items)
+	} else {
+		w := io.Writer(os.Stdout)
+		if *outPath != "" {
+			f, err := os.Create(*outPath)
+			if err != nil {
+				logger.Error("failed to create file", "error", err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		err = writeRSS(w, rss)
+	}
+	if err != nil {
+		logger.Error("failed to write feed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func writeRSS(w io.Writer, rss *feed.RSS) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(rss); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
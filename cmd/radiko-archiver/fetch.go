@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/radiko"
+)
+
+// runFetch runs `fetch [-list file] [-concurrency N] [-json] <url>... | <station> <start> [end]`.
+func runFetch(ctx context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "fetch")
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	listPath := fs.String("list", "", `file listing a URL, or a station ID with start and end times, on each line ("-" for stdin)`)
+	concurrency := fs.Int("concurrency", 2, "number of broadcasts fetched at a time")
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	_ = fs.Parse(args)
+
+	sches, err := fetchTargets(fs.Args(), *listPath)
+	if err != nil {
+		logger.Error("invalid arguments", "error", err)
+		return 2
+	}
+
+	if err := prepare(cnf); err != nil {
+		logger.Error("failed to prepare", "error", err)
+		return 1
+	}
+	results, err := radiko.FetchAll(ctx, cnf, sches, *concurrency)
+	if err != nil {
+		logger.Error("failed to fetch", "error", err)
+		return 1
+	}
+	if *asJSON {
+		err = printJSON(results)
+	} else {
+		err = writeFetchResults(os.Stdout, results)
+	}
+	if err != nil {
+		logger.Error("failed to print results", "error", err)
+		return 1
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// fetchTargets returns schedules of the arguments and the list file.
+// Arguments are URLs, or a station ID with start and optionally end times.
+func fetchTargets(args []string, listPath string) ([]radiko.Schedule, error) {
+	var sches []radiko.Schedule
+	if len(args) > 0 && strings.Contains(args[0], "://") {
+		for _, arg := range args {
+			s, err := radiko.ParseURL(arg)
+			if err != nil {
+				return nil, err
+			}
+			sches = append(sches, s)
+		}
+	} else if len(args) > 0 {
+		s, err := radiko.ParseTarget(args)
+		if err != nil {
+			return nil, err
+		}
+		sches = append(sches, s)
+	}
+
+	if listPath != "" {
+		var r io.Reader = os.Stdin
+		if listPath != "-" {
+			f, err := os.Open(listPath)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r = f
+		}
+		scanner := bufio.NewScanner(r)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			s, err := radiko.ParseTargetLine(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			sches = append(sches, s)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(sches) == 0 {
+		return nil, errors.New("usage: fetch <url>... | fetch <station> <start> [end] | fetch -list <file>")
+	}
+	return sches, nil
+}
+
+// writeFetchResults prints the result of each broadcast and the summary.
+func writeFetchResults(w io.Writer, results []radiko.FetchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESULT\tSTATION\tSTART\tNAME")
+	failed := 0
+	for _, r := range results {
+		s := r.Job.Schedule
+		result, detail := "done", r.Job.Name
+		if r.Error != "" {
+			failed++
+			result, detail = "failed", r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result, s.StationID, s.StartTime.In(radiko.JST).Format("2006-01-02 15:04"), detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d done, %d failed\n", len(results)-failed, failed)
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/radiko"
+)
+
+// runJobsHistory runs `jobs history [-json]`, printing jobs recorded in the job store.
+func runJobsHistory(_ context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "jobs-history")
+	fs := flag.NewFlagSet("jobs history", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print jobs as JSON")
+	_ = fs.Parse(args)
+
+	if err := os.MkdirAll(cnf.OutDirPath, 0755); err != nil {
+		logger.Error("failed to create output directory", "error", err)
+		return 1
+	}
+	store, err := radiko.OpenJobStore(radiko.JobStorePath(cnf.OutDirPath))
+	if err != nil {
+		logger.Error("failed to open job store", "error", err)
+		return 1
+	}
+	jobs, err := store.List(nil)
+	if err != nil {
+		logger.Error("failed to list jobs", "error", err)
+		return 1
+	}
+	if *asJSON {
+		err = printJSON(jobs)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "UPDATED\tSTART\tSTATION\tRULE\tSTATE\tATTEMPTS\tNAME/ERROR")
+		for _, job := range jobs {
+			s := job.Schedule
+			result := job.Name
+			if job.Error != "" {
+				result = job.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+				job.UpdatedAt.In(radiko.JST).Format("2006-01-02 15:04"), s.StartTime.In(radiko.JST).Format("2006-01-02 (Mon) 15:04"),
+				s.StationID, s.RuleName, job.State, job.Attempts, result)
+		}
+		err = tw.Flush()
+	}
+	if err != nil {
+		logger.Error("failed to print jobs", "error", err)
+		return 1
+	}
+	return 0
+}
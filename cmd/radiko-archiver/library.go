@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/library"
+	"github.com/abekoh/radiko-archiver/internal/radiko"
+)
+
+// runLibraryList runs `library list [-json]`.
+func runLibraryList(_ context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "library-list")
+	fs := flag.NewFlagSet("library list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print episodes as JSON")
+	_ = fs.Parse(args)
+
+	items, err := library.List(cnf.OutDirPath)
+	if err != nil {
+		logger.Error("failed to list episodes", "error", err)
+		return 1
+	}
+	if *asJSON {
+		err = printJSON(items)
+	} else {
+		err = writeItems(os.Stdout, items)
+	}
+	if err != nil {
+		logger.Error("failed to print episodes", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// runLibraryPrune runs `library prune -older-than 720h [-dry-run] [-force] [-json]`.
+// Episodes within the backfill window are kept unless forced, as the scheduler would fetch them again on startup.
+func runLibraryPrune(_ context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "library-prune")
+	fs := flag.NewFlagSet("library prune", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 0, "remove episodes which started before this duration ago")
+	dryRun := fs.Bool("dry-run", false, "print episodes to be removed without removing them")
+	force := fs.Bool("force", false, "allow -older-than shorter than the backfill window, whose episodes are fetched again on startup")
+	asJSON := fs.Bool("json", false, "print removed episodes as JSON")
+	_ = fs.Parse(args)
+
+	if *olderThan <= 0 {
+		logger.Error("invalid arguments", "error", "-older-than is required")
+		return 2
+	}
+	if *olderThan < cnf.Radiko.Backfill && !*force {
+		logger.Error("invalid arguments", "error", fmt.Sprintf(
+			"-older-than %s is shorter than the backfill window %s, whose episodes are fetched again on startup; give -force or a shorter backfill in config.toml",
+			*olderThan, cnf.Radiko.Backfill))
+		return 2
+	}
+	items, err := library.List(cnf.OutDirPath)
+	if err != nil {
+		logger.Error("failed to list episodes", "error", err)
+		return 1
+	}
+	threshold := time.Now().Add(-*olderThan)
+	pruned := make([]library.Item, 0)
+	code := 0
+	for _, item := range items {
+		if !item.Start.Before(threshold) {
+			continue
+		}
+		if !*dryRun {
+			if err := library.Remove(item); err != nil {
+				logger.Error("failed to remove episode", "name", item.Name, "error", err)
+				code = 1
+				continue
+			}
+			logger.Info("removed episode", "name", item.Name)
+		}
+		pruned = append(pruned, item)
+	}
+	if *asJSON {
+		err = printJSON(pruned)
+	} else {
+		err = writeItems(os.Stdout, pruned)
+	}
+	if err != nil {
+		logger.Error("failed to print episodes", "error", err)
+		return 1
+	}
+	return code
+}
+
+func writeItems(w io.Writer, items []library.Item) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tDURATION\tSIZE\tNAME")
+	for _, item := range items {
+		fmt.Fprintf(tw, "%s\t%s\t%.1fMB\t%s\n",
+			item.Start.In(radiko.JST).Format("2006-01-02 15:04"), item.End.Sub(item.Start), float64(item.Size)/(1<<20), item.Name)
+	}
+	return tw.Flush()
+}
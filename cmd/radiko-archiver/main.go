@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/abekoh/radiko-archiver/internal/audio"
 	"github.com/abekoh/radiko-archiver/internal/config"
 	"github.com/abekoh/radiko-archiver/internal/dropbox"
 	"github.com/abekoh/radiko-archiver/internal/feed"
@@ -61,12 +65,54 @@ func init() {
 	}
 }
 
+// command is a subcommand like "library prune", run with the arguments after its name.
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, cnf *config.Config, args []string) int
+}
+
+var commands = []command{
+	{"serve", "run the scheduler, the feed server and the Dropbox syncer (default)", runServe},
+	{"fetch", "fetch broadcasts by URLs, by a station ID with start and end times, or by a list of them", runFetch},
+	{"schedule list", "print upcoming schedules of the rules", runScheduleList},
+	{"jobs history", "print jobs recorded in the job store", runJobsHistory},
+	{"programs search", "search the program guide of stations", runProgramsSearch},
+	{"rules check", "validate rules and print their next schedules", runRulesCheck},
+	{"feed build", "write the RSS feed of archived episodes", runFeedBuild},
+	{"library list", "print archived episodes", runLibraryList},
+	{"library prune", "remove archived episodes older than a duration", runLibraryPrune},
+	{"dropbox sync", "upload all archived files into Dropbox", runDropboxSync},
+}
+
+// findCommand returns the command named by the leading arguments, and the rest of them.
+func findCommand(args []string) (command, []string, bool) {
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return c, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command] [command flags] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
 	logger := slog.Default().With("job", "main")
 
 	var configPath, radikoTSURL string
 	flag.StringVar(&configPath, "config", "config.toml", "config path")
-	flag.StringVar(&radikoTSURL, "now", "", "fetch and encode just now with radiko time-shifted URL")
+	flag.StringVar(&radikoTSURL, "now", "", "fetch and encode just now with radiko time-shifted URL, same as the fetch command")
+	flag.Usage = usage
 	flag.Parse()
 
 	cnf, err := config.Parse(configPath)
@@ -74,33 +120,86 @@ func main() {
 		logger.Error("failed to parse config", "error", err)
 		os.Exit(1)
 	}
-	if err := os.MkdirAll(cnf.OutDirPath, 0755); err != nil {
-		logger.Error("failed to create output directory", "error", err)
-		os.Exit(1)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	var code int
+	switch {
+	case flag.NArg() > 0:
+		c, args, ok := findCommand(flag.Args())
+		if !ok {
+			fmt.Fprintf(flag.CommandLine.Output(), "unknown command: %s\n", strings.Join(flag.Args(), " "))
+			usage()
+			os.Exit(2)
+		}
+		code = c.run(ctx, cnf, args)
+	case radikoTSURL != "":
+		code = runFetch(ctx, cnf, []string{radikoTSURL})
+	default:
+		code = runServe(ctx, cnf, nil)
 	}
+	stop()
+	os.Exit(code)
+}
 
-	if _, err := exec.LookPath("ffmpeg"); err != nil {
-		logger.Error("ffmpeg command is not available", "error", err)
-		os.Exit(1)
+func runServe(ctx context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "main")
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.DurationVar(&cnf.Radiko.Backfill, "backfill", cnf.Radiko.Backfill, "on startup, fetch broadcasts missed within this window (0 to disable), overriding backfill in config.toml")
+	_ = fs.Parse(args)
+
+	if err := prepare(cnf); err != nil {
+		logger.Error("failed to prepare", "error", err)
+		return 1
 	}
 
-	if radikoTSURL != "" {
-		radiko.RunFromURL(context.Background(), radikoTSURL, cnf)
-		return
+	store, err := radiko.OpenJobStore(radiko.JobStorePath(cnf.OutDirPath))
+	if err != nil {
+		logger.Error("failed to open job store", "error", err)
+		return 1
 	}
 
-	ctx := context.Background()
+	schedulerDone := radiko.RunScheduler(ctx, cnf, store)
 
-	radiko.RunScheduler(ctx, cnf)
+	// the feed server and the Dropbox syncer stop after running jobs finish, to publish their outputs
+	serveCtx, stopServe := context.WithCancel(context.Background())
+	defer stopServe()
+	var dones []<-chan struct{}
 	if cnf.Feed.Enabled {
-		feed.RunServer(ctx, cnf)
+		dones = append(dones, feed.RunServer(serveCtx, cnf))
 	}
 	if cnf.Dropbox.Enabled {
-		dropbox.RunSyncer(ctx, cnf)
+		dones = append(dones, dropbox.RunSyncer(serveCtx, cnf))
+	}
+
+	<-ctx.Done()
+	logger.Info("received signal, shutting down")
+	<-schedulerDone
+	stopServe()
+	for _, done := range dones {
+		<-done
 	}
+	logger.Info("shutdown completed")
+	return 0
+}
+
+// prepare creates the output directory and checks ffmpeg, before fetching.
+func prepare(cnf *config.Config) error {
+	if err := os.MkdirAll(cnf.OutDirPath, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if format, err := audio.ParseFormat(cnf.Output.Format); err == nil && format.Transcoded() {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return fmt.Errorf("ffmpeg command is required for the output format %s: %w", format, err)
+		}
+	}
+	return nil
+}
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGTERM)
-	<-sig
-	logger.Info("received SIGTERM")
+// printJSON prints v as indented JSON into stdout, for scripting.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
 }
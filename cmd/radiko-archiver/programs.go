@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/radiko"
+)
+
+// runProgramsSearch runs `programs search [-station LFR,TBS] [-date 2023-10-15] [-title regex] [-pfm regex] [-desc regex] [-from 24:00] [-to 27:00] [-json] [station...]`.
+func runProgramsSearch(ctx context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "programs-search")
+	fs := flag.NewFlagSet("programs search", flag.ExitOnError)
+	stations := fs.String("station", "", "comma-separated station IDs like LFR,TBS")
+	date := fs.String("date", "", "broadcast day like 2023-10-15 to search, instead of the weekly program guide")
+	title := fs.String("title", "", "regular expression of the title")
+	pfm := fs.String("pfm", "", "regular expression of the performers")
+	desc := fs.String("desc", "", "regular expression of the description")
+	from := fs.String("from", "", "programs on air after this time like 24:00, where hours before 5 are of the next day")
+	to := fs.String("to", "", "programs on air before this time like 27:00, where hours before 5 are of the next day")
+	asJSON := fs.Bool("json", false, "print programs as JSON")
+	_ = fs.Parse(args)
+
+	q := radiko.ProgramQuery{From: *from, To: *to}
+	for _, id := range append(strings.Split(*stations, ","), fs.Args()...) {
+		if id = strings.TrimSpace(id); id != "" {
+			q.StationIDs = append(q.StationIDs, radiko.StationID(id))
+		}
+	}
+	if len(q.StationIDs) == 0 {
+		logger.Error("invalid arguments", "error", "station is required")
+		return 2
+	}
+	if *date != "" {
+		d, err := time.ParseInLocation(time.DateOnly, *date, radiko.JST)
+		if err != nil {
+			logger.Error("invalid arguments", "error", err)
+			return 2
+		}
+		q.Date = d
+	}
+	for _, f := range []struct {
+		expr string
+		re   **regexp.Regexp
+	}{{*title, &q.Matcher.Title}, {*pfm, &q.Matcher.Pfm}, {*desc, &q.Matcher.Desc}} {
+		if f.expr == "" {
+			continue
+		}
+		re, err := regexp.Compile(f.expr)
+		if err != nil {
+			logger.Error("invalid arguments", "error", err)
+			return 2
+		}
+		*f.re = re
+	}
+
+	programs, err := radiko.SearchPrograms(ctx, cnf, q)
+	if err != nil {
+		logger.Error("failed to search programs", "error", err)
+		return 1
+	}
+	if *asJSON {
+		err = printJSON(programs)
+	} else {
+		err = writePrograms(os.Stdout, programs)
+	}
+	if err != nil {
+		logger.Error("failed to print programs", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// writePrograms prints each program with its time-shifted URL and a rules.toml snippet.
+func writePrograms(w io.Writer, programs []radiko.Program) error {
+	var sb strings.Builder
+	for i, p := range programs {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		ft, _ := time.ParseInLocation("20060102150405", p.Ft, radiko.JST)
+		to, _ := time.ParseInLocation("20060102150405", p.To, radiko.JST)
+		fmt.Fprintf(&sb, "%s-%s  %s  %s", ft.Format("2006-01-02 (Mon) 15:04"), to.Format("15:04"), p.StationID, p.Title)
+		if p.Pfm != "" {
+			fmt.Fprintf(&sb, "  (%s)", p.Pfm)
+		}
+		fmt.Fprintf(&sb, "\n%s\n%s", p.TimeshiftURL, p.Rule)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/radiko"
+)
+
+// runRulesCheck runs `rules check [-n N] [-json] [rules.toml]` and returns the exit code.
+func runRulesCheck(ctx context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "rules-check")
+	fs := flag.NewFlagSet("rules check", flag.ExitOnError)
+	n := fs.Int("n", 5, "number of upcoming schedules to print per rule")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	_ = fs.Parse(args)
+
+	path := cnf.RulesPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	report, err := radiko.CheckRules(ctx, path, cnf, *n, time.Now())
+	if err != nil {
+		logger.Error("failed to read rules", "error", err)
+		return 1
+	}
+
+	if *asJSON {
+		err = printJSON(report)
+	} else {
+		err = writeRulesReport(os.Stdout, path, report)
+	}
+	if err != nil {
+		logger.Error("failed to print result", "error", err)
+		return 1
+	}
+	if report.HasErrors() {
+		return 1
+	}
+	return 0
+}
+
+func writeRulesReport(w io.Writer, path string, report radiko.RulesReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tRULE\tSTATION\tSCHEDULE")
+	for _, p := range report.Rules {
+		if len(p.Schedules) == 0 {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t(%s)\n", p.Line, p.Rule, p.StationID, p.Note)
+			continue
+		}
+		for i, s := range p.Schedules {
+			when := s.StartTime.In(radiko.JST).Format("2006-01-02 (Mon) 15:04")
+			if s.Duration > 0 {
+				when += " - " + s.StartTime.Add(s.Duration).In(radiko.JST).Format("15:04")
+			}
+			if s.Live {
+				when += " live"
+			}
+			// schedules of area rules are on various stations
+			if i == 0 {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", p.Line, p.Rule, s.StationID, when)
+			} else if p.StationID == "" {
+				fmt.Fprintf(tw, "\t\t%s\t%s\n", s.StationID, when)
+			} else {
+				fmt.Fprintf(tw, "\t\t\t%s\n", when)
+			}
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.Issues) == 0 {
+		_, err := fmt.Fprintf(w, "\n%s: ok\n", path)
+		return err
+	}
+	var sb strings.Builder
+	sb.WriteString("\n")
+	for _, issue := range report.Issues {
+		fmt.Fprintf(&sb, "%s:%d: %s: ", path, issue.Line, issue.Level)
+		if issue.Rule != "" {
+			fmt.Fprintf(&sb, "%s: ", issue.Rule)
+		}
+		sb.WriteString(issue.Message + "\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/radiko"
+)
+
+// runScheduleList runs `schedule list [-json]`.
+func runScheduleList(ctx context.Context, cnf *config.Config, args []string) int {
+	logger := slog.Default().With("job", "schedule-list")
+	fs := flag.NewFlagSet("schedule list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print schedules as JSON")
+	_ = fs.Parse(args)
+
+	sches, err := radiko.UpcomingSchedules(ctx, cnf)
+	if err != nil {
+		logger.Error("failed to get schedules", "error", err)
+		return 1
+	}
+	if *asJSON {
+		err = printJSON(sches)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FETCH\tSTART\tSTATION\tRULE\tMODE")
+		for _, s := range sches {
+			mode := "timeshift"
+			if s.Live {
+				mode = "live"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				s.FetchTime.In(radiko.JST).Format("2006-01-02 15:04"), s.StartTime.In(radiko.JST).Format("2006-01-02 (Mon) 15:04"),
+				s.StationID, s.RuleName, mode)
+		}
+		err = tw.Flush()
+	}
+	if err != nil {
+		logger.Error("failed to print schedules", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+package audio
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Format is a container and codec of output audio files.
+type Format string
+
+const (
+	AAC  Format = "aac"  // raw ADTS stream as radiko serves, without transcoding
+	M4A  Format = "m4a"  // AAC remuxed into MP4
+	MP3  Format = "mp3"  // MP3 transcoded at the bitrate
+	Opus Format = "opus" // Opus in Ogg transcoded at the bitrate
+)
+
+var formats = []Format{AAC, M4A, MP3, Opus}
+
+func ParseFormat(s string) (Format, error) {
+	for _, f := range formats {
+		if strings.EqualFold(s, string(f)) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("invalid format: %s", s)
+}
+
+// FormatByExt returns the format of the file extension such as ".m4a".
+func FormatByExt(ext string) (Format, bool) {
+	for _, f := range formats {
+		if strings.EqualFold(ext, f.Ext()) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// Exts returns file extensions of all formats.
+func Exts() []string {
+	exts := make([]string, len(formats))
+	for i, f := range formats {
+		exts[i] = f.Ext()
+	}
+	return exts
+}
+
+func (f Format) Ext() string {
+	return "." + string(f)
+}
+
+func (f Format) MIMEType() string {
+	switch f {
+	case M4A:
+		return "audio/mp4"
+	case MP3:
+		return "audio/mpeg"
+	case Opus:
+		return "audio/ogg"
+	default:
+		return "audio/aac"
+	}
+}
+
+// Transcoded reports whether the format requires ffmpeg to transcode from AAC.
+func (f Format) Transcoded() bool {
+	return f != AAC
+}
+
+// Profile is a format and its bitrate for lossy transcoding like "128k".
+type Profile struct {
+	Format  Format
+	Bitrate string
+}
+
+func (p Profile) bitrate() string {
+	if p.Bitrate != "" {
+		return p.Bitrate
+	}
+	switch p.Format {
+	case MP3:
+		return "128k"
+	case Opus:
+		return "64k"
+	}
+	return ""
+}
+
+// FFmpegArgs returns ffmpeg arguments to transcode the AAC file in into out,
+// embedding tags and chapters of the FFMETADATA file and the cover image file if coverPath is not empty.
+// Ogg can't carry cover art, so Opus ignores the cover.
+func (p Profile) FFmpegArgs(in, out, metadataPath, coverPath string) []string {
+	args := []string{"-y", "-i", in, "-i", metadataPath}
+	if coverPath != "" && (p.Format == M4A || p.Format == MP3) {
+		args = append(args, "-i", coverPath, "-map", "0:a", "-map", "2:v", "-c:v", "copy", "-disposition:v", "attached_pic")
+		if p.Format == MP3 {
+			args = append(args, "-id3v2_version", "3")
+		}
+	} else {
+		args = append(args, "-map", "0:a")
+	}
+	args = append(args, "-map_metadata", "1", "-map_chapters", "1")
+	switch p.Format {
+	case M4A:
+		args = append(args, "-c:a", "copy", "-bsf:a", "aac_adtstoasc", "-movflags", "+faststart")
+	case MP3:
+		args = append(args, "-c:a", "libmp3lame", "-b:a", p.bitrate())
+	case Opus:
+		args = append(args, "-c:a", "libopus", "-b:a", p.bitrate())
+	}
+	return append(args, out)
+}
@@ -0,0 +1,187 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Tags is metadata embedded into output audio files.
+type Tags struct {
+	Title   string
+	Artist  string
+	Album   string
+	Date    string // like "2023-10-15T01:00"
+	Comment string
+
+	Cover     []byte
+	CoverMIME string
+
+	Chapters []Chapter
+	// Duration is the length of the audio, where the last chapter ends.
+	Duration time.Duration
+}
+
+// Chapter is a segment of the audio starting at Start.
+type Chapter struct {
+	Start time.Duration
+	Title string
+}
+
+// maxID3Chapters is the maximum number of chapters in the table of contents of ID3.
+const maxID3Chapters = 255
+
+// chapterEnd returns the end of the i-th chapter, which is the start of the next one.
+func (t Tags) chapterEnd(i int) time.Duration {
+	if i+1 < len(t.Chapters) {
+		return t.Chapters[i+1].Start
+	}
+	return t.Duration
+}
+
+func (t Tags) metadata() [][2]string {
+	return [][2]string{
+		{"title", t.Title},
+		{"artist", t.Artist},
+		{"album", t.Album},
+		{"date", t.Date},
+		{"comment", t.Comment},
+	}
+}
+
+// WriteID3 writes tags as an ID3v2.4 tag, which is put in front of ADTS streams.
+func WriteID3(w io.Writer, t Tags) error {
+	var frames bytes.Buffer
+	for _, f := range []struct {
+		id, text string
+	}{
+		{"TIT2", t.Title},
+		{"TPE1", t.Artist},
+		{"TALB", t.Album},
+		{"TDRC", t.Date},
+	} {
+		if f.text == "" {
+			continue
+		}
+		writeID3Frame(&frames, f.id, append([]byte{id3UTF8}, f.text...))
+	}
+	if t.Comment != "" {
+		// encoding, language, empty short description and text
+		data := append([]byte{id3UTF8}, "jpn"...)
+		data = append(data, 0)
+		writeID3Frame(&frames, "COMM", append(data, t.Comment...))
+	}
+	if len(t.Cover) > 0 {
+		// encoding, MIME type, picture type of front cover, empty description and picture
+		data := append([]byte{id3UTF8}, t.CoverMIME...)
+		data = append(data, 0, 0x03, 0)
+		writeID3Frame(&frames, "APIC", append(data, t.Cover...))
+	}
+	if len(t.Chapters) > 0 {
+		// top-level and ordered table of contents
+		// the entry count of CTOC is a byte, and chapters after maxID3Chapters are dropped
+		chapters := t.Chapters[:min(len(t.Chapters), maxID3Chapters)]
+		toc := append([]byte("toc"), 0, 0x03, byte(len(chapters)))
+		for i, c := range chapters {
+			id := fmt.Sprintf("chp%d", i)
+			toc = append(append(toc, id...), 0)
+
+			// element ID, start and end time in milliseconds, unused byte offsets, and the title as a sub-frame
+			var chap bytes.Buffer
+			chap.WriteString(id)
+			chap.WriteByte(0)
+			_ = binary.Write(&chap, binary.BigEndian, []uint32{
+				uint32(c.Start.Milliseconds()),
+				uint32(t.chapterEnd(i).Milliseconds()),
+				0xFFFFFFFF,
+				0xFFFFFFFF,
+			})
+			writeID3Frame(&chap, "TIT2", append([]byte{id3UTF8}, c.Title...))
+			writeID3Frame(&frames, "CHAP", chap.Bytes())
+		}
+		writeID3Frame(&frames, "CTOC", toc)
+	}
+
+	header := []byte{'I', 'D', '3', 4, 0, 0}
+	header = append(header, syncsafe(frames.Len())...)
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write ID3 header: %w", err)
+	}
+	if _, err := frames.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write ID3 frames: %w", err)
+	}
+	return nil
+}
+
+const id3UTF8 = 0x03
+
+// WriteFFMetadata writes tags and chapters in the FFMETADATA format, to be passed to ffmpeg.
+func WriteFFMetadata(w io.Writer, t Tags) error {
+	var buf bytes.Buffer
+	buf.WriteString(";FFMETADATA1\n")
+	for _, m := range t.metadata() {
+		if m[1] != "" {
+			fmt.Fprintf(&buf, "%s=%s\n", m[0], escapeFFMetadata(m[1]))
+		}
+	}
+	for i, c := range t.Chapters {
+		fmt.Fprintf(&buf, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			c.Start.Milliseconds(), t.chapterEnd(i).Milliseconds(), escapeFFMetadata(c.Title))
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+var ffMetadataEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"=", `\=`,
+	";", `\;`,
+	"#", `\#`,
+	"\n", "\\\n",
+)
+
+func escapeFFMetadata(s string) string {
+	return ffMetadataEscaper.Replace(s)
+}
+
+func writeID3Frame(w *bytes.Buffer, id string, data []byte) {
+	w.WriteString(id)
+	w.Write(syncsafe(len(data)))
+	_ = binary.Write(w, binary.BigEndian, uint16(0))
+	w.Write(data)
+}
+
+func syncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+// ChaptersExt is the file extension of Podcasting 2.0 chapters files.
+const ChaptersExt = ".chapters.json"
+
+// ChaptersMIMEType is the type of Podcasting 2.0 chapters files.
+const ChaptersMIMEType = "application/json+chapters"
+
+// WriteChaptersJSON writes chapters in the Podcasting 2.0 JSON chapters format.
+func WriteChaptersJSON(w io.Writer, chapters []Chapter) error {
+	type jsonChapter struct {
+		StartTime float64 `json:"startTime"`
+		Title     string  `json:"title"`
+	}
+	doc := struct {
+		Version  string        `json:"version"`
+		Chapters []jsonChapter `json:"chapters"`
+	}{
+		Version:  "1.2.0",
+		Chapters: make([]jsonChapter, len(chapters)),
+	}
+	for i, c := range chapters {
+		doc.Chapters[i] = jsonChapter{StartTime: c.Start.Seconds(), Title: c.Title}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
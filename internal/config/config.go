@@ -2,28 +2,101 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	"github.com/abekoh/radiko-archiver/internal/library"
 )
 
 type Config struct {
 	OutDirPath string  `toml:"out_dir_path"`
 	RulesPath  string  `toml:"rules_path"`
 	Radiko     Radiko  `toml:"radiko"`
+	Output     Output  `toml:"output"`
+	HTTP       HTTP    `toml:"http"`
 	Feed       Server  `toml:"feed"`
 	Dropbox    Dropbox `toml:"dropbox"`
 }
 
 type Radiko struct {
+	// OffsetTimeStr, PlannerIntervalStr, FetchTimeoutStr, ShutdownGracePeriodStr, BackfillStr, MaxAttempts and MaxJobs
+	// are optional, defaulting to Default.
 	OffsetTimeStr      string `toml:"offset_time"`
 	PlannerIntervalStr string `toml:"planner_interval"`
 	FetchTimeoutStr    string `toml:"fetch_timeout"`
+	// MaxAttempts is the maximum number of attempts of a job, retried with exponential backoff.
+	MaxAttempts int `toml:"max_attempts"`
+	// MaxJobs is the maximum number of jobs fetched and converted at a time. Live recordings are not counted.
+	MaxJobs int `toml:"max_jobs"`
+	// Running jobs are aborted when ShutdownGracePeriodStr passes after shutdown starts.
+	ShutdownGracePeriodStr string `toml:"shutdown_grace_period"`
+	// BackfillStr is how far back to look for missed broadcasts on startup, "0s" to disable.
+	BackfillStr string `toml:"backfill"`
+	// AreaID is the radiko area like "JP13", whose programs area rules match. Detected by the IP address if empty.
+	AreaID string `toml:"area_id"`
+	// Mail and Password log in to radiko premium, given by environment variables.
+	Mail     string `toml:"-"`
+	Password string `toml:"-"`
 
 	OffsetTime      time.Duration `toml:"-"`
 	PlannerInterval time.Duration `toml:"-"`
 	FetchTimeout    time.Duration `toml:"-"`
+
+	ShutdownGracePeriod time.Duration `toml:"-"`
+
+	// Backfill is also the window within which library prune keeps episodes, as they would be fetched again.
+	Backfill time.Duration `toml:"-"`
+}
+
+type Output struct {
+	// Format is one of aac, m4a, mp3 and opus. Formats other than aac require ffmpeg.
+	Format string `toml:"format"`
+	// Bitrate is for transcoding to mp3 and opus, like "128k".
+	Bitrate string `toml:"bitrate"`
+	// Filename is the template of episode names, like "{{.Rule}}/{{.Date}}_{{.Title}}". Slashes make subdirectories.
+	Filename string `toml:"filename"`
+}
+
+// HTTP configures the HTTP client shared by radiko API calls and downloads.
+type HTTP struct {
+	// Proxy is the URL of the proxy server. Proxy environment variables are used if empty.
+	Proxy     string `toml:"proxy"`
+	UserAgent string `toml:"user_agent"`
+	// RateLimit is the maximum number of requests per second to each host. Zero means no limit.
+	RateLimit float64 `toml:"rate_limit"`
+	// Concurrency is the number of concurrent chunk downloads, shared by all jobs.
+	Concurrency int `toml:"concurrency"`
+	// MaxAttempts is the maximum number of attempts to download a chunk.
+	MaxAttempts     int    `toml:"max_attempts"`
+	TimeoutStr      string `toml:"timeout"`
+	RetryBackoffStr string `toml:"retry_backoff"`
+
+	// Timeout is of each request.
+	Timeout time.Duration `toml:"-"`
+	// RetryBackoff is the wait before the second attempt, doubled on each attempt.
+	RetryBackoff time.Duration `toml:"-"`
+}
+
+func (h *HTTP) updateTime() error {
+	if h.TimeoutStr != "" {
+		timeout, err := time.ParseDuration(h.TimeoutStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse timeout: %w", err)
+		}
+		h.Timeout = timeout
+	}
+	if h.RetryBackoffStr != "" {
+		retryBackoff, err := time.ParseDuration(h.RetryBackoffStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse retry_backoff: %w", err)
+		}
+		h.RetryBackoff = retryBackoff
+	}
+	return nil
 }
 
 type Server struct {
@@ -38,35 +111,117 @@ type Dropbox struct {
 }
 
 func (r *Radiko) updateTime() error {
-	offsetTime, err := time.ParseDuration(r.OffsetTimeStr)
-	if err != nil {
-		return fmt.Errorf("failed to parse offset_time: %w", err)
+	if r.OffsetTimeStr != "" {
+		offsetTime, err := time.ParseDuration(r.OffsetTimeStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse offset_time: %w", err)
+		}
+		if offsetTime < 0 {
+			return fmt.Errorf("invalid offset_time: %s", r.OffsetTimeStr)
+		}
+		r.OffsetTime = offsetTime
+	}
+
+	if r.PlannerIntervalStr != "" {
+		plannerInterval, err := time.ParseDuration(r.PlannerIntervalStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse planner_interval: %w", err)
+		}
+		if plannerInterval <= 0 {
+			return fmt.Errorf("invalid planner_interval: %s", r.PlannerIntervalStr)
+		}
+		r.PlannerInterval = plannerInterval
 	}
-	r.OffsetTime = offsetTime
 
-	plannerInterval, err := time.ParseDuration(r.PlannerIntervalStr)
-	if err != nil {
-		return fmt.Errorf("failed to parse planner_interval: %w", err)
+	if r.FetchTimeoutStr != "" {
+		fetchTimeout, err := time.ParseDuration(r.FetchTimeoutStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse fetch_timeout: %w", err)
+		}
+		if fetchTimeout <= 0 {
+			return fmt.Errorf("invalid fetch_timeout: %s", r.FetchTimeoutStr)
+		}
+		r.FetchTimeout = fetchTimeout
 	}
-	r.PlannerInterval = plannerInterval
 
-	fetchTimeout, err := time.ParseDuration(r.FetchTimeoutStr)
-	if err != nil {
-		return fmt.Errorf("failed to parse fetch_timeout: %w", err)
+	if r.ShutdownGracePeriodStr != "" {
+		shutdownGracePeriod, err := time.ParseDuration(r.ShutdownGracePeriodStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse shutdown_grace_period: %w", err)
+		}
+		if shutdownGracePeriod < 0 {
+			return fmt.Errorf("invalid shutdown_grace_period: %s", r.ShutdownGracePeriodStr)
+		}
+		r.ShutdownGracePeriod = shutdownGracePeriod
+	}
+
+	if r.BackfillStr != "" {
+		backfill, err := time.ParseDuration(r.BackfillStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse backfill: %w", err)
+		}
+		if backfill < 0 {
+			return fmt.Errorf("invalid backfill: %s", r.BackfillStr)
+		}
+		r.Backfill = backfill
 	}
-	r.FetchTimeout = fetchTimeout
 
 	return nil
 }
 
+// areaIDRegexp matches area IDs of radiko, JP1 to JP47 by prefecture.
+var areaIDRegexp = regexp.MustCompile(`^JP([1-9]|[1-3][0-9]|4[0-7])$`)
+
+// Default returns the config with defaults of the settings omitted in config.toml.
+func Default() *Config {
+	return &Config{
+		Radiko: Radiko{
+			OffsetTime:          6 * time.Hour,
+			PlannerInterval:     10 * time.Minute,
+			FetchTimeout:        3 * time.Minute,
+			ShutdownGracePeriod: 5 * time.Minute,
+			Backfill:            7 * 24 * time.Hour,
+			MaxAttempts:         5,
+			MaxJobs:             2,
+		},
+	}
+}
+
 func Parse(path string) (*Config, error) {
-	var cnf Config
-	if _, err := toml.DecodeFile(path, &cnf); err != nil {
+	cnf := Default()
+	if _, err := toml.DecodeFile(path, cnf); err != nil {
 		return nil, err
 	}
 	if err := cnf.Radiko.updateTime(); err != nil {
 		return nil, err
 	}
+	if err := cnf.HTTP.updateTime(); err != nil {
+		return nil, err
+	}
+	if cnf.Radiko.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("invalid max_attempts: %d", cnf.Radiko.MaxAttempts)
+	}
+	if cnf.Radiko.MaxJobs <= 0 {
+		return nil, fmt.Errorf("invalid max_jobs: %d", cnf.Radiko.MaxJobs)
+	}
+	if cnf.HTTP.Proxy != "" {
+		if _, err := url.Parse(cnf.HTTP.Proxy); err != nil {
+			return nil, fmt.Errorf("failed to parse proxy: %w", err)
+		}
+	}
+	if cnf.Radiko.AreaID != "" && !areaIDRegexp.MatchString(cnf.Radiko.AreaID) {
+		return nil, fmt.Errorf("invalid area_id: %s", cnf.Radiko.AreaID)
+	}
+	if cnf.Output.Format != "" {
+		if _, err := audio.ParseFormat(cnf.Output.Format); err != nil {
+			return nil, fmt.Errorf("failed to parse output format: %w", err)
+		}
+	}
+	if _, err := library.NewNamer(cnf.Output.Filename); err != nil {
+		return nil, fmt.Errorf("failed to parse output filename: %w", err)
+	}
+	cnf.Radiko.Mail = os.Getenv("RADIKO_MAIL")
+	cnf.Radiko.Password = os.Getenv("RADIKO_PASSWORD")
 	cnf.Dropbox.Token = os.Getenv("DROPBOX_TOKEN")
-	return &cnf, nil
+	return cnf, nil
 }
@@ -2,42 +2,81 @@ package dropbox
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 
 	"log/slog"
 
 	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/library"
 	sdk "github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/files"
 	"github.com/fsnotify/fsnotify"
 )
 
-func RunSyncer(ctx context.Context, cnf *config.Config) {
+// RunSyncer syncs files in the output directory into Dropbox.
+// When ctx is done, pending uploads are flushed and then the returned channel is closed.
+func RunSyncer(ctx context.Context, cnf *config.Config) <-chan struct{} {
 	logger := slog.Default().With("job", "dropbox-uploader")
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		watcher, err := fsnotify.NewWatcher()
 		if err != nil {
 			panic(fmt.Errorf("failed to create watcher: %w", err))
 		}
 		defer watcher.Close()
-		if err := watcher.Add(cnf.OutDirPath); err != nil {
+		if err := library.Watch(watcher, cnf.OutDirPath); err != nil {
 			panic(fmt.Errorf("failed to add watcher: %w", err))
 		}
 
+		handle := func(event fsnotify.Event) {
+			if library.Hidden(event.Name) {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := library.Watch(watcher, event.Name); err != nil {
+						logger.Error("failed to add watcher", "error", err)
+					}
+					// episodes may be moved into the new directory before it is watched
+					_ = filepath.WalkDir(event.Name, func(path string, d fs.DirEntry, err error) error {
+						if err == nil && !d.IsDir() && !library.Hidden(path) {
+							sync(ctx, cnf, path, fsnotify.Event{Name: path, Op: fsnotify.Create})
+						}
+						return nil
+					})
+					return
+				}
+			}
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Remove) {
+				sync(ctx, cnf, event.Name, event)
+			}
+		}
+
 		logger.Info("start watching")
 		for {
 			select {
 			case event := <-watcher.Events:
-				if event.Has(fsnotify.Create & fsnotify.Write & fsnotify.Remove) {
-					sync(ctx, cnf, event.Name, event)
-				}
+				handle(event)
 			case <-ctx.Done():
-				return
+				logger.Info("flush pending uploads")
+				for {
+					select {
+					case event := <-watcher.Events:
+						handle(event)
+					default:
+						logger.Info("stop watching")
+						return
+					}
+				}
 			}
 		}
 	}()
+	return done
 }
 
 func sync(ctx context.Context, cnf *config.Config, path string, event fsnotify.Event) {
@@ -45,43 +84,19 @@ func sync(ctx context.Context, cnf *config.Config, path string, event fsnotify.E
 
 	logger.Debug("start sync", "op", event.Op, "path", path)
 
-	client := files.New(sdk.Config{
-		Token: cnf.Dropbox.Token,
-	})
-
 	if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
 		logger.Info("uploading", "path", path)
-
-		f, err := os.Open(path)
-		if err != nil {
-			logger.Error("failed to open file", "error", err)
-			return
-		}
-		defer f.Close()
-
-		commitInfo := files.NewCommitInfo("/" + filepath.Base(path))
-		commitInfo.Mode.Tag = "overwrite"
-		_, err = client.Upload(&files.UploadArg{
-			CommitInfo:  *commitInfo,
-			ContentHash: "", // TODO: calculate hash
-		}, f)
-		if err != nil {
+		if err := upload(cnf, path); err != nil {
 			logger.Error("failed to upload into dropbox", "error", err)
 			return
 		}
-
 		logger.Info("uploaded", "path", path)
 	} else if event.Has(fsnotify.Remove) {
 		logger.Info("deleting", "path", path)
-
-		_, err := client.DeleteV2(&files.DeleteArg{
-			Path: "/" + filepath.Base(path),
-		})
-		if err != nil {
+		if err := remove(cnf, path); err != nil {
 			logger.Error("failed to delete from dropbox", "error", err)
 			return
 		}
-
 		logger.Info("deleted", "path", path)
 	} else {
 		logger.Error("unknown operation", "op", event.Op)
@@ -89,3 +104,86 @@ func sync(ctx context.Context, cnf *config.Config, path string, event fsnotify.E
 	}
 
 }
+
+// Result is the result of syncing a file.
+type Result struct {
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+}
+
+// SyncAll uploads all files in the output directory into Dropbox, overwriting existing ones.
+// Failures of each file are recorded in the results, and the rest of the files are still uploaded.
+func SyncAll(ctx context.Context, cnf *config.Config) ([]Result, error) {
+	logger := slog.Default().With("job", "dropbox-sync-all")
+	if cnf.Dropbox.Token == "" {
+		return nil, errors.New("DROPBOX_TOKEN is not set")
+	}
+	results := make([]Result, 0)
+	err := filepath.WalkDir(cnf.OutDirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != cnf.OutDirPath && library.Hidden(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		logger.Info("uploading", "path", path)
+		r := Result{Path: path}
+		if err := upload(cnf, path); err != nil {
+			logger.Error("failed to upload into dropbox", "error", err)
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+		return nil
+	})
+	if err != nil {
+		return results, fmt.Errorf("failed to walk: %w", err)
+	}
+	return results, nil
+}
+
+func upload(cnf *config.Config, path string) error {
+	client := files.New(sdk.Config{
+		Token: cnf.Dropbox.Token,
+	})
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	commitInfo := files.NewCommitInfo(dropboxPath(cnf.OutDirPath, path))
+	commitInfo.Mode.Tag = "overwrite"
+	_, err = client.Upload(&files.UploadArg{
+		CommitInfo:  *commitInfo,
+		ContentHash: "", // TODO: calculate hash
+	}, f)
+	return err
+}
+
+func remove(cnf *config.Config, path string) error {
+	client := files.New(sdk.Config{
+		Token: cnf.Dropbox.Token,
+	})
+	_, err := client.DeleteV2(&files.DeleteArg{
+		Path: dropboxPath(cnf.OutDirPath, path),
+	})
+	return err
+}
+
+// dropboxPath returns the path in Dropbox of the file in outDirPath, keeping subdirectories.
+func dropboxPath(outDirPath, path string) string {
+	rel, err := filepath.Rel(outDirPath, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return "/" + filepath.ToSlash(rel)
+}
@@ -5,8 +5,8 @@ import (
 	"context"
 	"encoding/xml"
 	"fmt"
-	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
@@ -16,10 +16,11 @@ import (
 
 	"log/slog"
 
+	"github.com/abekoh/radiko-archiver/internal/audio"
 	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/library"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/mux"
-	goradiko "github.com/yyoshiki41/go-radiko"
 )
 
 var (
@@ -27,17 +28,41 @@ var (
 	rssMu sync.RWMutex
 )
 
-func RunServer(ctx context.Context, cnf *config.Config) {
+const shutdownTimeout = 30 * time.Second
+
+// RunServer serves the RSS feed and assets.
+// The returned channel is closed when the server is shut down after ctx is done.
+func RunServer(ctx context.Context, cnf *config.Config) <-chan struct{} {
+	logger := slog.Default().With("job", "feed-server")
 	go func() {
 		updateRSS(ctx, cnf.OutDirPath, cnf.Feed.BaseURL)
 	}()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", getRSS)
+	r.HandleFunc("/assets/{filename:.+}", downloadAsset(cnf.OutDirPath))
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cnf.Feed.Port),
+		Handler: r,
+	}
 	go func() {
-		r := mux.NewRouter()
-		r.HandleFunc("/", getRSS)
-		r.HandleFunc("/assets/{filename}", downloadAsset(cnf.OutDirPath))
-		http.Handle("/", r)
-		http.ListenAndServe(fmt.Sprintf(":%d", cnf.Feed.Port), nil)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("failed to serve", "error", err)
+		}
 	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		c, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(c); err != nil {
+			logger.Error("failed to shutdown server", "error", err)
+		}
+		logger.Debug("server stopped")
+	}()
+	return done
 }
 
 func updateRSS(ctx context.Context, outDirPath, baseURL string) {
@@ -47,7 +72,7 @@ func updateRSS(ctx context.Context, outDirPath, baseURL string) {
 		panic(fmt.Errorf("failed to create watcher: %w", err))
 	}
 	defer watcher.Close()
-	if err := watcher.Add(outDirPath); err != nil {
+	if err := library.Watch(watcher, outDirPath); err != nil {
 		panic(fmt.Errorf("failed to add watcher: %w", err))
 	}
 	rs, err := generateRSS(outDirPath, baseURL)
@@ -60,7 +85,18 @@ func updateRSS(ctx context.Context, outDirPath, baseURL string) {
 
 	for {
 		select {
-		case <-watcher.Events:
+		case event := <-watcher.Events:
+			if library.Hidden(event.Name) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				// watch subdirectories created for new episodes
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := library.Watch(watcher, event.Name); err != nil {
+						logger.Error("failed to add watcher", "error", err)
+					}
+				}
+			}
 			rs, err := generateRSS(outDirPath, baseURL)
 			if err != nil {
 				logger.Error("failed to generate RSS", "error", err)
@@ -77,74 +113,49 @@ func updateRSS(ctx context.Context, outDirPath, baseURL string) {
 	}
 }
 
+// Build generates the RSS feed of episodes in outDirPath.
+func Build(outDirPath, baseURL string) (*RSS, error) {
+	return generateRSS(outDirPath, baseURL)
+}
+
 func generateRSS(outDirPath, baseURL string) (*RSS, error) {
 	logger := slog.Default().With("job", "generateRSS")
-	var items []Item
-	if err := filepath.WalkDir(outDirPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return fmt.Errorf("failed to walk: %w", err)
-		}
-		if d.IsDir() {
-			return nil
-		}
-		if filepath.Ext(path) != ".xml" {
-			return nil
-		}
-		aacFilePath := path[:len(path)-4] + ".aac"
-		aacFileStat, err := os.Stat(aacFilePath)
-		if os.IsNotExist(err) {
-			return fmt.Errorf("failed to find aac file: %w", err)
-		}
-		aacFileSize := aacFileStat.Size()
-
-		xmlFile, err := os.ReadFile(path)
-		if err != nil {
-			return fmt.Errorf("failed to read file: %w", err)
-		}
-		var prog goradiko.Prog
-		if err := xml.Unmarshal(xmlFile, &prog); err != nil {
-			return fmt.Errorf("failed to unmarshal xml: %w", err)
-		}
-
-		startTime, err := time.ParseInLocation("20060102150405", prog.Ft, JST)
-		if err != nil {
-			return fmt.Errorf("failed to parse start time: %w", err)
-		}
-		endTime, err := time.ParseInLocation("20060102150405", prog.To, JST)
-		if err != nil {
-			return fmt.Errorf("failed to parse end time: %w", err)
+	episodes, err := library.List(outDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list episodes: %w", err)
+	}
+	items := make([]Item, 0, len(episodes))
+	for _, ep := range episodes {
+		prog := ep.Program
+		var chapters *Chapters
+		if ep.ChaptersPath != "" {
+			chapters = &Chapters{
+				URL:  assetURL(baseURL, outDirPath, ep.ChaptersPath),
+				Type: audio.ChaptersMIMEType,
+			}
 		}
 		items = append(items, Item{
 			Title:       prog.Title,
 			Description: "<![CDATA[ " + prog.Info + "]]>",
-			PubDate:     startTime.Format(time.RFC1123Z),
+			PubDate:     ep.Start.Format(time.RFC1123Z),
 			Link:        prog.URL,
 			Author:      prog.Pfm,
 			Subtitle:    prog.SubTitle,
-			Duration:    formatDuration(endTime.Sub(startTime)),
+			Duration:    formatDuration(ep.End.Sub(ep.Start)),
 			Enclosure: Enclosure{
-				URL:    baseURL + "/assets/" + filepath.Base(aacFilePath),
-				Type:   "audio/aac",
-				Length: aacFileSize,
+				URL:    assetURL(baseURL, outDirPath, ep.AudioPath),
+				Type:   ep.Format.MIMEType(),
+				Length: ep.Size,
 			},
-			PubDateTime: startTime,
+			Chapters:    chapters,
+			PubDateTime: ep.Start,
 		})
-		return nil
-	}); err != nil {
-		return nil, fmt.Errorf("failed to walk: %w", err)
 	}
-	slices.SortFunc(items, func(i, j Item) int {
-		if i.PubDateTime.After(j.PubDateTime) {
-			return -1
-		} else if i.PubDateTime.Before(j.PubDateTime) {
-			return 1
-		}
-		return 0
-	})
 	rs := &RSS{
 		Version: "2.0",
 		Atom:    "http://www.w3.org/2005/Atom",
 		Itunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Podcast: "https://podcastindex.org/namespace/1.0",
 		Channel: Channel{
 			Title:       "abekoh's Podcast feed",
 			Description: "Podcast feed for abekoh",
@@ -165,6 +176,19 @@ func generateRSS(outDirPath, baseURL string) (*RSS, error) {
 	return rs, nil
 }
 
+// assetURL returns the URL of the file in outDirPath, escaping each path segment.
+func assetURL(baseURL, outDirPath, path string) string {
+	rel, err := filepath.Rel(outDirPath, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return baseURL + "/assets/" + strings.Join(segments, "/")
+}
+
 func formatDuration(d time.Duration) string {
 	hours := int(d.Hours())
 	minutes := int(d.Minutes()) % 60
@@ -192,10 +216,16 @@ func downloadAsset(outDirPath string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		filename := vars["filename"]
-		if !strings.HasSuffix(filename, ".aac") {
+		if strings.HasSuffix(filename, audio.ChaptersExt) {
+			w.Header().Set("Content-Type", audio.ChaptersMIMEType)
+		} else if _, ok := audio.FormatByExt(filepath.Ext(filename)); !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		if !filepath.IsLocal(filepath.FromSlash(filename)) || slices.ContainsFunc(strings.Split(filename, "/"), library.Hidden) {
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
-		http.ServeFile(w, r, filepath.Join(outDirPath, filename))
+		http.ServeFile(w, r, filepath.Join(outDirPath, filepath.FromSlash(filename)))
 	}
 }
@@ -0,0 +1,129 @@
+package feed
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBaseURL = "http://localhost:8080"
+
+// writeEpisode writes the audio and the metadata of an episode named name into outDirPath.
+func writeEpisode(t *testing.T, outDirPath, name, ext string, start time.Time) {
+	t.Helper()
+	basePath := filepath.Join(outDirPath, filepath.FromSlash(name))
+	require.NoError(t, os.MkdirAll(filepath.Dir(basePath), 0755))
+	require.NoError(t, os.WriteFile(basePath+ext, []byte("audio"), 0644))
+	prog := fmt.Sprintf(`<Prog ft="%s" to="%s"><title>%s</title></Prog>`,
+		start.Format("20060102150405"), start.Add(time.Hour).Format("20060102150405"), name)
+	require.NoError(t, os.WriteFile(basePath+".xml", []byte(prog), 0644))
+}
+
+func TestGenerateRSS(t *testing.T) {
+	outDirPath := t.TempDir()
+	start := time.Date(2023, 10, 15, 1, 0, 0, 0, time.FixedZone("Asia/Tokyo", 9*60*60))
+	tests := []struct {
+		name     string
+		ext      string
+		mimeType string
+	}{
+		{name: "aac", ext: ".aac", mimeType: "audio/aac"},
+		{name: "m4a", ext: ".m4a", mimeType: "audio/mp4"},
+		{name: "mp3", ext: ".mp3", mimeType: "audio/mpeg"},
+		{name: "rule/opus", ext: ".opus", mimeType: "audio/ogg"},
+	}
+	for i, tt := range tests {
+		writeEpisode(t, outDirPath, tt.name, tt.ext, start.Add(time.Duration(i)*24*time.Hour))
+	}
+	// staged episodes are not published
+	writeEpisode(t, outDirPath, ".staging-LFR_20231015010000/episode", ".aac", start)
+	require.NoError(t, os.WriteFile(filepath.Join(outDirPath, "rule", "opus"+audio.ChaptersExt), []byte(`{"version":"1.2.0","chapters":[]}`), 0644))
+
+	rs, err := generateRSS(outDirPath, testBaseURL)
+	require.NoError(t, err)
+	require.Len(t, rs.Channel.Items, len(tests))
+	items := make(map[string]Item)
+	for _, item := range rs.Channel.Items {
+		items[item.Title] = item
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item, ok := items[tt.name]
+			require.True(t, ok)
+			assert.Equal(t, tt.mimeType, item.Enclosure.Type)
+			assert.Equal(t, testBaseURL+"/assets/"+tt.name+tt.ext, item.Enclosure.URL)
+			assert.Equal(t, int64(len("audio")), item.Enclosure.Length)
+			// only episodes with chapters files refer to them
+			encoded, err := xml.Marshal(item)
+			require.NoError(t, err)
+			if tt.name == "rule/opus" {
+				assert.Contains(t, string(encoded), `<podcast:chapters url="`+testBaseURL+"/assets/rule/opus"+audio.ChaptersExt+`" type="`+audio.ChaptersMIMEType+`">`)
+				require.NotNil(t, item.Chapters)
+				assert.Equal(t, testBaseURL+"/assets/rule/opus"+audio.ChaptersExt, item.Chapters.URL)
+				assert.Equal(t, audio.ChaptersMIMEType, item.Chapters.Type)
+			} else {
+				assert.Nil(t, item.Chapters)
+				assert.NotContains(t, string(encoded), "podcast:chapters")
+			}
+		})
+	}
+}
+
+func TestDownloadAsset(t *testing.T) {
+	outDirPath := t.TempDir()
+	start := time.Date(2023, 10, 15, 1, 0, 0, 0, time.FixedZone("Asia/Tokyo", 9*60*60))
+	for _, ext := range []string{".aac", ".m4a", ".mp3", ".opus"} {
+		writeEpisode(t, outDirPath, "rule/episode", ext, start)
+	}
+	writeEpisode(t, outDirPath, ".staging-LFR_20231015010000/episode", ".aac", start)
+	require.NoError(t, os.WriteFile(filepath.Join(outDirPath, "rule", "episode"+audio.ChaptersExt), []byte(`{"version":"1.2.0","chapters":[]}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outDirPath, "rule", ".hidden.aac"), []byte("audio"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outDirPath, "rule", "episode.wav"), []byte("audio"), 0644))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/assets/{filename:.+}", downloadAsset(outDirPath))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{path: "/assets/rule/episode.aac", status: http.StatusOK},
+		{path: "/assets/rule/episode" + audio.ChaptersExt, status: http.StatusOK, contentType: audio.ChaptersMIMEType},
+		{path: "/assets/rule/missing" + audio.ChaptersExt, status: http.StatusNotFound},
+		{path: "/assets/rule/episode.m4a", status: http.StatusOK},
+		{path: "/assets/rule/episode.mp3", status: http.StatusOK},
+		{path: "/assets/rule/episode.opus", status: http.StatusOK},
+		// suffixes other than audio formats
+		{path: "/assets/rule/episode.xml", status: http.StatusNotFound},
+		{path: "/assets/rule/episode.wav", status: http.StatusNotFound},
+		{path: "/assets/rule/episode.aac.xml", status: http.StatusNotFound},
+		// hidden files and directories
+		{path: "/assets/rule/.hidden.aac", status: http.StatusNotFound},
+		{path: "/assets/.staging-LFR_20231015010000/episode.aac", status: http.StatusNotFound},
+		{path: "/assets/.radiko-archiver.db", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			if tt.contentType != "" {
+				assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -12,6 +12,7 @@ type RSS struct {
 	Version string   `xml:"version,attr"`
 	Atom    string   `xml:"xmlns:atom,attr"`
 	Itunes  string   `xml:"xmlns:itunes,attr"`
+	Podcast string   `xml:"xmlns:podcast,attr"`
 	Channel Channel  `xml:"channel"`
 }
 
@@ -47,6 +48,7 @@ type Item struct {
 	Subtitle    string    `xml:"itunes:subtitle,omitempty"`
 	Duration    string    `xml:"itunes:duration,omitempty"`
 	Enclosure   Enclosure `xml:"enclosure"`
+	Chapters    *Chapters `xml:"podcast:chapters,omitempty"`
 
 	PubDateTime time.Time `xml:"-"`
 }
@@ -66,3 +68,9 @@ type Enclosure struct {
 	Type   string `xml:"type,attr"`
 	Length int64  `xml:"length,attr"`
 }
+
+// Chapters refers to the Podcasting 2.0 chapters file of the episode.
+type Chapters struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
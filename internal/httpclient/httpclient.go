@@ -0,0 +1,91 @@
+// Package httpclient builds the HTTP client shared by radiko API calls and downloads.
+package httpclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"golang.org/x/time/rate"
+)
+
+const defaultTimeout = time.Minute
+
+// New returns an HTTP client with the proxy, the rate limit, the timeout and the User-Agent of cnf.
+func New(cnf config.HTTP) (*http.Client, error) {
+	transport := http.DefaultTransport
+	if cnf.Proxy != "" {
+		proxyURL, err := url.Parse(cnf.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		t, ok := http.DefaultTransport.(*http.Transport)
+		if ok {
+			t = t.Clone()
+		} else {
+			t = &http.Transport{}
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+		transport = t
+	}
+	if cnf.RateLimit > 0 {
+		transport = &rateLimitTransport{
+			base:     transport,
+			limit:    rate.Limit(cnf.RateLimit),
+			limiters: make(map[string]*rate.Limiter),
+		}
+	}
+	if cnf.UserAgent != "" {
+		transport = &userAgentTransport{base: transport, userAgent: cnf.UserAgent}
+	}
+	timeout := cnf.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
+
+// rateLimitTransport limits requests per second to each host.
+type rateLimitTransport struct {
+	base  http.RoundTripper
+	limit rate.Limit
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter(req.URL.Host).Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (t *rateLimitTransport) limiter(host string) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.limiters[host]
+	if !ok {
+		l = rate.NewLimiter(t.limit, max(1, int(t.limit)))
+		t.limiters[host] = l
+	}
+	return l
+}
+
+// userAgentTransport overrides User-Agent of requests.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
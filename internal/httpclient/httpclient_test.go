@@ -0,0 +1,54 @@
+package httpclient
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var userAgents []string
+	httpmock.RegisterResponder("GET", "https://radiko.jp/",
+		func(req *http.Request) (*http.Response, error) {
+			userAgents = append(userAgents, req.Header.Get("User-Agent"))
+			return httpmock.NewStringResponse(http.StatusOK, "ok"), nil
+		})
+
+	client, err := New(config.HTTP{
+		UserAgent: "radiko-archiver",
+		RateLimit: 10,
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		resp, err := client.Get("https://radiko.jp/")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+	// 10 requests of the burst and 5 more at 10 requests per second
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.Equal(t, "radiko-archiver", userAgents[0])
+	assert.Len(t, userAgents, 15)
+}
+
+func TestNew_Proxy(t *testing.T) {
+	client, err := New(config.HTTP{Proxy: "http://proxy.example.com:8080"})
+	require.NoError(t, err)
+	transport, ok := client.Transport.(*http.Transport)
+	require.True(t, ok)
+	req, err := http.NewRequest(http.MethodGet, "https://radiko.jp/", nil)
+	require.NoError(t, err)
+	proxyURL, err := transport.Proxy(req)
+	require.NoError(t, err)
+	assert.Equal(t, "http://proxy.example.com:8080", proxyURL.String())
+	assert.Equal(t, defaultTimeout, client.Timeout)
+}
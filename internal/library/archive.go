@@ -0,0 +1,149 @@
+package library
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+var jst = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+// Item is an episode archived in the output directory.
+// An episode consists of the audio, the program metadata as XML and optionally the chapters.
+type Item struct {
+	// Name is the slash-separated path relative to the output directory without extension.
+	Name         string       `json:"name"`
+	AudioPath    string       `json:"audio_path"`
+	Format       audio.Format `json:"format"`
+	Size         int64        `json:"size"`
+	ChaptersPath string       `json:"chapters_path,omitempty"`
+	MetadataPath string       `json:"metadata_path"`
+	// Start and End are of the recording, which may be a part of the program or span several.
+	Start   time.Time     `json:"start"`
+	End     time.Time     `json:"end"`
+	Program goradiko.Prog `json:"program"`
+}
+
+// List returns episodes in outDirPath, newest first.
+// Episodes which cannot be read, such as metadata without audio, are logged and skipped.
+// Hidden files and directories are skipped, as they are in progress.
+func List(outDirPath string) ([]Item, error) {
+	var items []Item
+	if err := filepath.WalkDir(outDirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to walk: %w", err)
+		}
+		// skip files and directories in progress, such as staging directories of fetchers
+		if path != outDirPath && Hidden(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || filepath.Ext(path) != ".xml" {
+			return nil
+		}
+		item, err := readItem(outDirPath, path)
+		if err != nil {
+			// a stray or orphaned metadata file should not hide the rest of the library
+			slog.Default().With("job", "library").Warn("skip unreadable episode", "path", path, "error", err)
+			return nil
+		}
+		items = append(items, item)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(items, func(a, b Item) int {
+		return b.Start.Compare(a.Start)
+	})
+	return items, nil
+}
+
+func readItem(outDirPath, metadataPath string) (Item, error) {
+	basePath := strings.TrimSuffix(metadataPath, ".xml")
+	audioPath, format, err := findAudioFile(basePath)
+	if err != nil {
+		return Item{}, fmt.Errorf("failed to find audio file: %w", err)
+	}
+	audioFileStat, err := os.Stat(audioPath)
+	if err != nil {
+		return Item{}, fmt.Errorf("failed to stat audio file: %w", err)
+	}
+
+	xmlFile, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return Item{}, fmt.Errorf("failed to read file: %w", err)
+	}
+	var prog goradiko.Prog
+	if err := xml.Unmarshal(xmlFile, &prog); err != nil {
+		return Item{}, fmt.Errorf("failed to unmarshal xml: %w", err)
+	}
+	startTime, err := time.ParseInLocation("20060102150405", prog.Ft, jst)
+	if err != nil {
+		return Item{}, fmt.Errorf("failed to parse start time: %w", err)
+	}
+	endTime, err := time.ParseInLocation("20060102150405", prog.To, jst)
+	if err != nil {
+		return Item{}, fmt.Errorf("failed to parse end time: %w", err)
+	}
+
+	name, err := filepath.Rel(outDirPath, basePath)
+	if err != nil {
+		return Item{}, err
+	}
+	item := Item{
+		Name:         filepath.ToSlash(name),
+		AudioPath:    audioPath,
+		Format:       format,
+		Size:         audioFileStat.Size(),
+		MetadataPath: metadataPath,
+		Start:        startTime,
+		End:          endTime,
+		Program:      prog,
+	}
+	if chaptersPath := basePath + audio.ChaptersExt; fileExists(chaptersPath) {
+		item.ChaptersPath = chaptersPath
+	}
+	return item, nil
+}
+
+// findAudioFile returns the audio file of basePath in any format.
+func findAudioFile(basePath string) (string, audio.Format, error) {
+	for _, ext := range audio.Exts() {
+		if fileExists(basePath + ext) {
+			format, _ := audio.FormatByExt(ext)
+			return basePath + ext, format, nil
+		}
+	}
+	return "", "", fmt.Errorf("no audio file for %s", basePath)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Remove deletes files of the episode.
+// The metadata is removed first, so that a partly removed episode is not listed.
+func Remove(item Item) error {
+	for _, path := range []string{item.MetadataPath, item.AudioPath, item.ChaptersPath} {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
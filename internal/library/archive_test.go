@@ -0,0 +1,52 @@
+package library
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	write("20231015010000_LFR_A.xml", `<Prog ft="20231015010000" to="20231015030000"><title>A</title></Prog>`)
+	write("20231015010000_LFR_A.m4a", "audio")
+	write("B/20231022010000_LFR_B.xml", `<Prog ft="20231022010000" to="20231022030000"><title>B</title></Prog>`)
+	write("B/20231022010000_LFR_B.aac", "audio!")
+	write("B/20231022010000_LFR_B"+audio.ChaptersExt, "{}")
+	// in progress
+	write(".staging-1/prog.xml", `<Prog ft="20231029010000" to="20231029030000"></Prog>`)
+	// orphaned metadata without audio, and a stray file
+	write("20231029010000_LFR_C.xml", `<Prog ft="20231029010000" to="20231029030000"><title>C</title></Prog>`)
+	write("notes.xml", "<notes/>")
+	write("notes.aac", "audio")
+
+	items, err := List(dir)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "B/20231022010000_LFR_B", items[0].Name)
+	assert.Equal(t, audio.AAC, items[0].Format)
+	assert.Equal(t, int64(6), items[0].Size)
+	assert.NotEmpty(t, items[0].ChaptersPath)
+	assert.Equal(t, "B", items[0].Program.Title)
+	assert.Equal(t, "20231015010000_LFR_A", items[1].Name)
+	assert.Equal(t, audio.M4A, items[1].Format)
+	assert.Empty(t, items[1].ChaptersPath)
+	assert.Equal(t, 2*60*60.0, items[1].End.Sub(items[1].Start).Seconds())
+
+	require.NoError(t, Remove(items[0]))
+	items, err = List(dir)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	entries, err := os.ReadDir(filepath.Join(dir, "B"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,165 @@
+// Package library manages episodes archived in the output directory.
+package library
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultNameTemplate is the naming template of episodes, which is compatible with older versions.
+const DefaultNameTemplate = "{{.Ft}}_{{.StationID}}_{{.Title}}"
+
+const (
+	// maxComponentBytes is the limit of each path component, which most filesystems allow.
+	maxComponentBytes = 255
+	// maxNameBytes is the limit of the file name of episodes, leaving room for extensions like ".chapters.json".
+	maxNameBytes = 200
+)
+
+// Episode is the data given to naming templates.
+type Episode struct {
+	Rule      string
+	StationID string
+	Station   string
+	Title     string
+	Pfm       string
+	Start     time.Time
+}
+
+// Date returns the start date like "20231015".
+func (e Episode) Date() string {
+	return e.Start.Format("20060102")
+}
+
+// Time returns the start time like "0100".
+func (e Episode) Time() string {
+	return e.Start.Format("1504")
+}
+
+// Ft returns the start date and time like "20231015010000", as radiko does.
+func (e Episode) Ft() string {
+	return e.Start.Format("20060102150405")
+}
+
+// Namer names episodes by a template like "{{.Rule}}/{{.Date}}_{{.Title}}".
+// Slashes in the template make subdirectories, while values of episodes are sanitized not to make any.
+type Namer struct {
+	tmpl *template.Template
+}
+
+func NewNamer(text string) (*Namer, error) {
+	if text == "" {
+		text = DefaultNameTemplate
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse name template: %w", err)
+	}
+	n := &Namer{tmpl: tmpl}
+	if _, err := n.Name(Episode{Rule: "rule", StationID: "LFR", Title: "title", Start: time.Now()}); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Name returns the slash-separated path of the episode relative to the output directory, without extension.
+func (n *Namer) Name(e Episode) (string, error) {
+	e.Rule = Sanitize(e.Rule)
+	e.StationID = Sanitize(e.StationID)
+	e.Station = Sanitize(e.Station)
+	e.Title = Sanitize(e.Title)
+	e.Pfm = Sanitize(e.Pfm)
+
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, e); err != nil {
+		return "", fmt.Errorf("failed to execute name template: %w", err)
+	}
+	var components []string
+	for _, c := range strings.Split(buf.String(), "/") {
+		// leading dots make hidden files, which are ignored as in progress
+		c = strings.TrimLeft(strings.TrimSpace(c), ".")
+		if c == "" {
+			continue
+		}
+		components = append(components, truncate(c, maxComponentBytes))
+	}
+	if len(components) == 0 {
+		return "", errors.New("empty name")
+	}
+	last := len(components) - 1
+	components[last] = truncate(components[last], maxNameBytes)
+	return path.Join(components...), nil
+}
+
+// reservedChars are not allowed in file names by Windows or Dropbox, and replaced with full-width ones.
+var reservedChars = strings.NewReplacer(
+	"/", "／",
+	`\`, "＼",
+	":", "：",
+	"*", "＊",
+	"?", "？",
+	`"`, "＂",
+	"<", "＜",
+	">", "＞",
+	"|", "｜",
+)
+
+// Sanitize makes s safe as a part of a file name.
+func Sanitize(s string) string {
+	s = strings.ToValidUTF8(s, "_")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	s = reservedChars.Replace(s)
+	s = strings.Join(strings.Fields(s), " ")
+	// Dropbox and Windows reject names ending with dots
+	return strings.TrimRight(s, ". ")
+}
+
+// truncate shortens s within n bytes, not breaking UTF-8 sequences.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return strings.TrimRight(s, ". ")
+}
+
+// Hidden reports whether the file is hidden, such as files and directories in progress.
+func Hidden(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".")
+}
+
+// Watch adds root and its subdirectories except hidden ones to the watcher,
+// as fsnotify doesn't watch directories recursively.
+func Watch(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && Hidden(path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
@@ -0,0 +1,65 @@
+package library
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamer_Name(t *testing.T) {
+	e := Episode{
+		Rule:      "オードリー",
+		StationID: "LFR",
+		Title:     "オードリーのオールナイトニッポン",
+		Start:     time.Date(2023, 10, 15, 1, 0, 0, 0, time.FixedZone("Asia/Tokyo", 9*60*60)),
+	}
+
+	t.Run("default", func(t *testing.T) {
+		n, err := NewNamer("")
+		require.NoError(t, err)
+		name, err := n.Name(e)
+		require.NoError(t, err)
+		assert.Equal(t, "20231015010000_LFR_オードリーのオールナイトニッポン", name)
+	})
+
+	t.Run("subdirectory", func(t *testing.T) {
+		n, err := NewNamer("{{.Rule}}/{{.Date}}_{{.Time}}_{{.Title}}")
+		require.NoError(t, err)
+		name, err := n.Name(e)
+		require.NoError(t, err)
+		assert.Equal(t, "オードリー/20231015_0100_オードリーのオールナイトニッポン", name)
+	})
+
+	t.Run("sanitized", func(t *testing.T) {
+		n, err := NewNamer("{{.Rule}}/{{.Title}}")
+		require.NoError(t, err)
+		e := e
+		e.Rule = ".."
+		e.Title = "AC/DC: Back in Black?\n"
+		name, err := n.Name(e)
+		require.NoError(t, err)
+		assert.Equal(t, "AC／DC： Back in Black？", name)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		n, err := NewNamer("{{.Title}}")
+		require.NoError(t, err)
+		e := e
+		e.Title = strings.Repeat("あ", 100)
+		name, err := n.Name(e)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(name), maxNameBytes)
+		assert.True(t, utf8.ValidString(name))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := NewNamer("{{.Unknown}}")
+		assert.Error(t, err)
+		_, err = NewNamer("{{.Title")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,153 @@
+package radiko
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var errInvalidADTS = errors.New("invalid ADTS stream")
+
+const (
+	adtsHeaderLength = 7
+	id3HeaderLength  = 10
+)
+
+// concatADTS writes ADTS frames of the files into w in order.
+// ID3 tags which radiko chunks carry are dropped, and frame headers are validated.
+func concatADTS(w io.Writer, paths []string) error {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read chunk: %w", err)
+		}
+		if _, err := writeADTSFrames(w, data); err != nil {
+			return fmt.Errorf("failed to write frames of %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// writeADTSFrames writes ADTS frames in data into w, skipping ID3 tags, and returns the number of frames.
+func writeADTSFrames(w io.Writer, data []byte) (int, error) {
+	return walkADTSFrames(data, func(frame []byte) error {
+		_, err := w.Write(frame)
+		return err
+	})
+}
+
+// walkADTSFrames calls fn with each ADTS frame in data, skipping ID3 tags, and returns the number of frames.
+func walkADTSFrames(data []byte, fn func(frame []byte) error) (int, error) {
+	frames := 0
+	for offset := 0; offset < len(data); {
+		rest := data[offset:]
+		if bytes.HasPrefix(rest, []byte("ID3")) {
+			tagLength, err := id3TagLength(rest)
+			if err != nil {
+				return frames, fmt.Errorf("%w: at %d: %w", errInvalidADTS, offset, err)
+			}
+			offset += tagLength
+			continue
+		}
+		frameLength, err := adtsFrameLength(rest)
+		if err != nil {
+			return frames, fmt.Errorf("%w: at %d: %w", errInvalidADTS, offset, err)
+		}
+		if err := fn(rest[:frameLength]); err != nil {
+			return frames, err
+		}
+		frames++
+		offset += frameLength
+	}
+	if frames == 0 {
+		return 0, fmt.Errorf("%w: no frames", errInvalidADTS)
+	}
+	return frames, nil
+}
+
+// adtsSamplingFrequencies are indexed by the sampling frequency index of ADTS headers.
+var adtsSamplingFrequencies = [...]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsSamplesPerFrame is the number of samples in an AAC frame.
+const adtsSamplesPerFrame = 1024
+
+// adtsDuration validates ADTS frames in data and returns their playback duration.
+func adtsDuration(data []byte) (time.Duration, error) {
+	var duration time.Duration
+	_, err := walkADTSFrames(data, func(frame []byte) error {
+		freq := adtsSamplingFrequencies[(frame[2]>>2)&0x0F]
+		duration += time.Duration(adtsSamplesPerFrame) * time.Second / time.Duration(freq)
+		return nil
+	})
+	return duration, err
+}
+
+// validateChunk reports an error if data is not a valid ADTS stream of about the expected duration.
+// The duration is not checked if expected is zero.
+func validateChunk(data []byte, expected time.Duration) error {
+	duration, err := adtsDuration(data)
+	if err != nil {
+		return err
+	}
+	if expected <= 0 {
+		return nil
+	}
+	tolerance := max(time.Second, expected/5)
+	if diff := duration - expected; diff > tolerance || diff < -tolerance {
+		return fmt.Errorf("%w: duration %s, expected %s", errInvalidADTS, duration, expected)
+	}
+	return nil
+}
+
+// adtsFrameLength validates the ADTS frame header at the head of data and returns the length of the frame.
+func adtsFrameLength(data []byte) (int, error) {
+	if len(data) < adtsHeaderLength {
+		return 0, errors.New("truncated header")
+	}
+	// syncword 0xFFF and layer 0
+	if data[0] != 0xFF || data[1]&0xF6 != 0xF0 {
+		return 0, errors.New("missing syncword")
+	}
+	if samplingIndex := (data[2] >> 2) & 0x0F; samplingIndex > 12 {
+		return 0, fmt.Errorf("invalid sampling frequency index %d", samplingIndex)
+	}
+	headerLength := adtsHeaderLength
+	if data[1]&0x01 == 0 {
+		// CRC follows the header
+		headerLength += 2
+	}
+	frameLength := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+	if frameLength <= headerLength {
+		return 0, fmt.Errorf("invalid frame length %d", frameLength)
+	}
+	if frameLength > len(data) {
+		return 0, fmt.Errorf("truncated frame of length %d", frameLength)
+	}
+	return frameLength, nil
+}
+
+// id3TagLength returns the length of the ID3v2 tag at the head of data, including its header and footer.
+func id3TagLength(data []byte) (int, error) {
+	if len(data) < id3HeaderLength {
+		return 0, errors.New("truncated ID3 header")
+	}
+	var size int
+	for _, b := range data[6:10] {
+		if b&0x80 != 0 {
+			return 0, errors.New("invalid ID3 tag size")
+		}
+		size = size<<7 | int(b)
+	}
+	length := id3HeaderLength + size
+	if data[5]&0x10 != 0 {
+		// footer present
+		length += id3HeaderLength
+	}
+	if length > len(data) {
+		return 0, errors.New("truncated ID3 tag")
+	}
+	return length, nil
+}
@@ -0,0 +1,57 @@
+package radiko
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func id3Tag(payload []byte) []byte {
+	size := len(payload)
+	return append([]byte{
+		'I', 'D', '3', 4, 0, 0,
+		byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F),
+	}, payload...)
+}
+
+func TestConcatADTS(t *testing.T) {
+	sample, err := os.ReadFile("testdata/sample3.aac")
+	require.NoError(t, err)
+
+	var frames bytes.Buffer
+	n, err := writeADTSFrames(&frames, sample)
+	require.NoError(t, err)
+	assert.Greater(t, n, 0)
+	assert.Equal(t, sample, frames.Bytes())
+
+	dir := t.TempDir()
+	chunk1 := filepath.Join(dir, "1.aac")
+	chunk2 := filepath.Join(dir, "2.aac")
+	require.NoError(t, os.WriteFile(chunk1, append(id3Tag([]byte("PRIV timestamp")), sample...), 0644))
+	require.NoError(t, os.WriteFile(chunk2, append(id3Tag(nil), sample...), 0644))
+
+	var out bytes.Buffer
+	require.NoError(t, concatADTS(&out, []string{chunk1, chunk2}))
+	assert.Equal(t, append(append([]byte{}, sample...), sample...), out.Bytes())
+}
+
+func TestConcatADTS_Invalid(t *testing.T) {
+	sample, err := os.ReadFile("testdata/sample3.aac")
+	require.NoError(t, err)
+
+	for name, data := range map[string][]byte{
+		"html":      []byte("<html><body>403 Forbidden</body></html>"),
+		"truncated": sample[:len(sample)-1],
+		"id3 only":  id3Tag([]byte("PRIV timestamp")),
+		"empty":     {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := writeADTSFrames(&bytes.Buffer{}, data)
+			assert.ErrorIs(t, err, errInvalidADTS)
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package radiko
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	"github.com/abekoh/radiko-archiver/internal/config"
+)
+
+// RuleIssue is a problem in rules.toml found by CheckRules.
+type RuleIssue struct {
+	Line    int    `json:"line"`
+	Rule    string `json:"rule,omitempty"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+const (
+	IssueError   = "error"
+	IssueWarning = "warning"
+)
+
+// RulePreview is a rule with its upcoming schedules.
+type RulePreview struct {
+	Line      int        `json:"line"`
+	Rule      string     `json:"rule"`
+	StationID StationID  `json:"station_id,omitempty"`
+	Schedules []Schedule `json:"schedules"`
+	// Note explains why schedules are not given.
+	Note string `json:"note,omitempty"`
+}
+
+// RulesReport is the result of CheckRules.
+type RulesReport struct {
+	Issues []RuleIssue   `json:"issues"`
+	Rules  []RulePreview `json:"rules"`
+}
+
+// HasErrors reports whether rules.toml is rejected by the planner.
+func (r RulesReport) HasErrors() bool {
+	for _, issue := range r.Issues {
+		if issue.Level == IssueError {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRules validates every rule in rules.toml at path, detects duplicated and overlapping rules,
+// and previews the next n schedules of each valid rule as the planner plans them at now.
+// The program guide is fetched to resolve program rules and the end of programs; when it is not available,
+// program rules are not previewed and schedules without the duration overlap only when they start at the same time.
+// Errors are returned only when the file cannot be read.
+func CheckRules(ctx context.Context, path string, cnf *config.Config, n int, now time.Time) (RulesReport, error) {
+	report := RulesReport{Issues: []RuleIssue{}, Rules: []RulePreview{}}
+	lines, err := readLines(path)
+	if err != nil {
+		return report, err
+	}
+	cRules, md, err := decodeRules(path)
+	if err != nil {
+		issue := RuleIssue{Level: IssueError, Message: err.Error()}
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			issue.Line = parseErr.Position.Line
+			issue.Message = parseErr.Message
+		}
+		report.Issues = append(report.Issues, issue)
+		return report, nil
+	}
+	defaultProfile, err := outputProfile(cnf.Output.Format, cnf.Output.Bitrate, audio.Profile{Format: audio.AAC})
+	if err != nil {
+		report.Issues = append(report.Issues, RuleIssue{Level: IssueError, Message: fmt.Sprintf("invalid output config: %s", err)})
+		return report, nil
+	}
+
+	ruleLines := tableLines(lines, "rules")
+	lineOf := func(i int) int {
+		if i < len(ruleLines) {
+			return ruleLines[i]
+		}
+		return 0
+	}
+	for _, key := range md.Undecoded() {
+		name := key[len(key)-1]
+		for _, line := range keyLines(lines, name) {
+			report.Issues = append(report.Issues, RuleIssue{Line: line, Level: IssueWarning, Message: fmt.Sprintf("unknown key %s", name)})
+		}
+	}
+
+	type checked struct {
+		rule Rule
+		line int
+	}
+	var valid []checked
+	names := make(map[string]int)
+	for i, cRule := range cRules {
+		line := lineOf(i)
+		if first, ok := names[cRule.Name]; ok {
+			report.Issues = append(report.Issues, RuleIssue{Line: line, Rule: cRule.Name, Level: IssueWarning,
+				Message: fmt.Sprintf("duplicated name with the rule at line %d", first)})
+		} else {
+			names[cRule.Name] = line
+		}
+		if cRule.Name == "" {
+			report.Issues = append(report.Issues, RuleIssue{Line: line, Level: IssueWarning, Message: "name is empty"})
+		}
+		rule, err := newRule(cRule, cnf, defaultProfile)
+		if err != nil {
+			report.Issues = append(report.Issues, RuleIssue{Line: line, Rule: cRule.Name, Level: IssueError, Message: err.Error()})
+			continue
+		}
+		valid = append(valid, checked{rule: rule, line: line})
+	}
+
+	rules := make([]Rule, len(valid))
+	for i, c := range valid {
+		rules[i] = c.rule
+	}
+	guide, err := checkGuide(ctx, cnf, rules, now)
+	if err != nil {
+		report.Issues = append(report.Issues, RuleIssue{Level: IssueWarning, Message: fmt.Sprintf("failed to fetch program guide: %s", err)})
+	}
+
+	previews := make([]RulePreview, len(valid))
+	for i, c := range valid {
+		previews[i] = RulePreview{Line: c.line, Rule: c.rule.Name, StationID: c.rule.StationID, Schedules: []Schedule{}}
+		// schedules start after the offset time before now, as in newSchedules
+		t := now.Add(-c.rule.OffsetTime)
+		if c.rule.IsProgramRule() {
+			if guide == nil {
+				previews[i].Note = "program guide not available"
+				continue
+			}
+			sches := c.rule.ProgramSchedules(guide, t)
+			slices.SortFunc(sches, func(a, b Schedule) int { return a.StartTime.Compare(b.StartTime) })
+			previews[i].Schedules = sches[:min(n, len(sches))]
+			if len(previews[i].Schedules) == 0 {
+				previews[i].Note = "no matching programs in the program guide"
+			}
+			continue
+		}
+		for s, ok := c.rule.nextSchedule(t); ok && len(previews[i].Schedules) < n; s, ok = c.rule.nextSchedule(s.StartTime) {
+			previews[i].Schedules = append(previews[i].Schedules, s)
+		}
+		if len(previews[i].Schedules) == 0 {
+			previews[i].Note = "no more broadcasts"
+		}
+	}
+	report.Rules = previews
+
+	for i := range previews {
+		for j := i + 1; j < len(previews); j++ {
+			a, b := previews[i], previews[j]
+			if s, ok := overlap(guide, a.Schedules, b.Schedules); ok {
+				report.Issues = append(report.Issues, RuleIssue{Line: b.Line, Rule: b.Rule, Level: IssueWarning,
+					Message: fmt.Sprintf("overlaps with the rule %s at line %d on %s", a.Rule, a.Line, s.StartTime.In(JST).Format("2006-01-02 15:04"))})
+			}
+		}
+	}
+	return report, nil
+}
+
+// checkGuide fetches the program guide of program rules as UpcomingSchedules does,
+// and the weekly programs of the other stations whose schedules end with the program.
+// It returns nil when no rule needs the guide.
+func checkGuide(ctx context.Context, cnf *config.Config, rules []Rule, now time.Time) (ProgramGuide, error) {
+	programStations := programStationIDs(rules)
+	var stationIDs []StationID
+	for _, rule := range rules {
+		if !rule.IsProgramRule() && rule.Duration == 0 &&
+			!slices.Contains(programStations, rule.StationID) && !slices.Contains(stationIDs, rule.StationID) {
+			stationIDs = append(stationIDs, rule.StationID)
+		}
+	}
+	if len(programStations) == 0 && !hasAreaRule(rules) && len(stationIDs) == 0 {
+		return nil, nil
+	}
+	radikoClient, err := newAreaRadikoClient(cnf)
+	if err != nil {
+		return nil, err
+	}
+	guide, err := fetchRulesGuide(ctx, radikoClient, rules, now.Add(-maxOffsetTime(rules)), now)
+	if err != nil {
+		return nil, err
+	}
+	weekly, err := fetchProgramGuide(ctx, radikoClient, stationIDs)
+	if err != nil {
+		return nil, err
+	}
+	guide.merge(weekly)
+	return guide, nil
+}
+
+// overlap returns the first schedule of a which overlaps a schedule of b on the same station.
+// Schedules without the duration end with the program on air at the start in guide,
+// and overlap only when they start at the same time if the program is not in guide.
+func overlap(guide ProgramGuide, a, b []Schedule) (Schedule, bool) {
+	end := func(s Schedule) time.Time {
+		if s.Duration > 0 {
+			return s.StartTime.Add(s.Duration)
+		}
+		if pg := guide.onAir(s.StationID, s.StartTime); pg != nil {
+			if end, err := s.endTime(pg); err == nil {
+				return end
+			}
+		}
+		return s.StartTime.Add(time.Nanosecond)
+	}
+	for _, sa := range a {
+		for _, sb := range b {
+			if sa.StationID == sb.StationID && sa.StartTime.Before(end(sb)) && sb.StartTime.Before(end(sa)) {
+				return sa, true
+			}
+		}
+	}
+	return Schedule{}, false
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+var tableHeaderRegexp = regexp.MustCompile(`^\s*\[\[\s*([A-Za-z0-9_-]+)\s*]]`)
+
+// tableLines returns line numbers of headers of the array of tables.
+func tableLines(lines []string, name string) []int {
+	var nums []int
+	for i, line := range lines {
+		if m := tableHeaderRegexp.FindStringSubmatch(line); m != nil && m[1] == name {
+			nums = append(nums, i+1)
+		}
+	}
+	return nums
+}
+
+// keyLines returns line numbers where the key is set.
+func keyLines(lines []string, key string) []int {
+	re := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(key) + `\s*=`)
+	var nums []int
+	for i, line := range lines {
+		if re.MatchString(line) && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			nums = append(nums, i+1)
+		}
+	}
+	return nums
+}
@@ -0,0 +1,201 @@
+package radiko
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRules(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	httpmock.RegisterResponder("GET",
+		`=~^https://radiko\.jp/v3/program/station/weekly/(LFR|TBS)\.xml$`,
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+	httpmock.RegisterResponder("GET",
+		`=~^https://radiko\.jp/v3/program/date/\d{8}/JP13\.xml$`,
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+	ctx := context.Background()
+	// Saturday
+	now := time.Date(2023, 10, 14, 12, 0, 0, 0, JST)
+
+	t.Run("valid", func(t *testing.T) {
+		report, err := CheckRules(ctx, writeRules(t, `
+[[rules]]
+name = "オードリーのオールナイトニッポン"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+
+[[rules]]
+name = "ケツビ"
+title = "ケツビ"
+`), config.Default(), 3, now)
+		require.NoError(t, err)
+		assert.Empty(t, report.Issues)
+		assert.False(t, report.HasErrors())
+		require.Len(t, report.Rules, 2)
+		assert.Equal(t, 2, report.Rules[0].Line)
+		require.Len(t, report.Rules[0].Schedules, 3)
+		assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), report.Rules[0].Schedules[0].StartTime)
+		assert.Equal(t, time.Date(2023, 10, 29, 1, 0, 0, 0, JST), report.Rules[0].Schedules[2].StartTime)
+		// program rules are resolved against the program guide
+		assert.Equal(t, 8, report.Rules[1].Line)
+		require.Len(t, report.Rules[1].Schedules, 1)
+		assert.Equal(t, TBS, report.Rules[1].Schedules[0].StationID)
+		assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), report.Rules[1].Schedules[0].StartTime)
+		assert.Empty(t, report.Rules[1].Note)
+	})
+
+	t.Run("invalid entries", func(t *testing.T) {
+		report, err := CheckRules(ctx, writeRules(t, `
+[[rules]]
+name = "no station"
+weekday = "Sun"
+start = "01:00"
+
+[[rules]]
+name = "typo"
+station_id = "LFR"
+weekday = "Sun"
+strat = "01:00"
+
+[[rules]]
+name = "bad start"
+station_id = "LFR"
+weekday = "Sun"
+start = "30:00"
+`), config.Default(), 3, now)
+		require.NoError(t, err)
+		assert.True(t, report.HasErrors())
+		assert.Empty(t, report.Rules)
+		var lines []int
+		for _, issue := range report.Issues {
+			lines = append(lines, issue.Line)
+		}
+		// unknown key first, then invalid rules
+		assert.Equal(t, []int{11, 2, 7, 13}, lines)
+		assert.Equal(t, IssueWarning, report.Issues[0].Level)
+		assert.Equal(t, "unknown key strat", report.Issues[0].Message)
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		report, err := CheckRules(ctx, writeRules(t, `
+[[rules]]
+name = "broken
+`), config.Default(), 3, now)
+		require.NoError(t, err)
+		assert.True(t, report.HasErrors())
+		require.Len(t, report.Issues, 1)
+		assert.Equal(t, 3, report.Issues[0].Line)
+	})
+
+	t.Run("duplicates and overlaps", func(t *testing.T) {
+		report, err := CheckRules(ctx, writeRules(t, `
+[[rules]]
+name = "番組"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+duration = "2h"
+
+[[rules]]
+name = "番組"
+station_id = "LFR"
+weekday = ["Sat", "Sun"]
+start = "02:00"
+
+[[rules]]
+name = "別の局"
+station_id = "TBS"
+weekday = "Sun"
+start = "01:00"
+`), config.Default(), 3, now)
+		require.NoError(t, err)
+		assert.False(t, report.HasErrors())
+		require.Len(t, report.Issues, 2)
+		assert.Equal(t, 9, report.Issues[0].Line)
+		assert.Contains(t, report.Issues[0].Message, "duplicated name")
+		assert.Equal(t, 9, report.Issues[1].Line)
+		assert.Contains(t, report.Issues[1].Message, "overlaps with the rule 番組 at line 2")
+	})
+
+	t.Run("overlaps until the end of programs", func(t *testing.T) {
+		report, err := CheckRules(ctx, writeRules(t, `
+[[rules]]
+name = "オードリー"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+
+[[rules]]
+name = "後半"
+station_id = "LFR"
+weekday = "Sun"
+start = "02:30"
+duration = "30m"
+
+[[rules]]
+name = "番組表"
+station_id = "LFR"
+title = "オードリーのオールナイトニッポン"
+`), config.Default(), 3, now)
+		require.NoError(t, err)
+		require.Len(t, report.Rules, 3)
+		require.Len(t, report.Rules[2].Schedules, 1)
+		assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), report.Rules[2].Schedules[0].StartTime)
+		var messages []string
+		for _, issue := range report.Issues {
+			messages = append(messages, issue.Rule+": "+issue.Message)
+		}
+		// the program on air from 01:00 to 03:00 includes 02:30
+		assert.Equal(t, []string{
+			"後半: overlaps with the rule オードリー at line 2 on 2023-10-15 01:00",
+			"番組表: overlaps with the rule オードリー at line 2 on 2023-10-15 01:00",
+			"番組表: overlaps with the rule 後半 at line 8 on 2023-10-15 02:30",
+		}, messages)
+	})
+}
+
+func TestCheckRules_NoGuide(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	report, err := CheckRules(context.Background(), writeRules(t, `
+[[rules]]
+name = "オードリー"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+
+[[rules]]
+name = "後半"
+station_id = "LFR"
+weekday = "Sun"
+start = "02:30"
+duration = "30m"
+
+[[rules]]
+name = "番組表"
+station_id = "LFR"
+title = "オードリーのオールナイトニッポン"
+`), config.Default(), 3, time.Date(2023, 10, 14, 12, 0, 0, 0, JST))
+	require.NoError(t, err)
+	assert.False(t, report.HasErrors())
+	// without the end of programs, only schedules at the same time overlap
+	require.Len(t, report.Issues, 1)
+	assert.Equal(t, IssueWarning, report.Issues[0].Level)
+	assert.Contains(t, report.Issues[0].Message, "failed to fetch program guide")
+	require.Len(t, report.Rules, 3)
+	assert.Empty(t, report.Rules[2].Schedules)
+	assert.Equal(t, "program guide not available", report.Rules[2].Note)
+}
@@ -0,0 +1,269 @@
+package radiko
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	defaultDownloadConcurrency = 64
+	defaultDownloadAttempts    = 3
+	defaultRetryBackoff        = time.Second
+
+	// maxChunkBytes is large enough for chunks of several minutes.
+	maxChunkBytes = 10 << 20
+	// gapTolerance is the allowed difference between the end of a chunk and the start of the next one.
+	gapTolerance = time.Second
+)
+
+var errChunklistGap = errors.New("chunklist has a gap")
+
+// chunk is a segment in the chunklist of HLS.
+type chunk struct {
+	URL string
+	// Time is the start of the chunk given by EXT-X-PROGRAM-DATE-TIME, zero if absent.
+	Time time.Time
+	// Duration is given by EXTINF, zero if absent.
+	Duration time.Duration
+}
+
+// downloader downloads chunklists and chunks by the HTTP client.
+type downloader struct {
+	client *http.Client
+	// sem limits concurrent chunk downloads across all jobs sharing the downloader, not to hammer the CDN.
+	sem          *semaphore.Weighted
+	maxAttempts  int
+	retryBackoff time.Duration
+}
+
+func newDownloader(client *http.Client, cnf config.HTTP) *downloader {
+	concurrency := cnf.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultDownloadConcurrency
+	}
+	d := &downloader{
+		client:       client,
+		sem:          semaphore.NewWeighted(int64(concurrency)),
+		maxAttempts:  cnf.MaxAttempts,
+		retryBackoff: cnf.RetryBackoff,
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = defaultDownloadAttempts
+	}
+	if d.retryBackoff <= 0 {
+		d.retryBackoff = defaultRetryBackoff
+	}
+	return d
+}
+
+// fetchChunklist fetches the chunklist of the m3u8 playlist at uri, requested with header which may be nil.
+func (d *downloader) fetchChunklist(ctx context.Context, uri string, header http.Header) ([]chunk, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	chunks, err := parseChunklist(resp.Body, uri)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("empty chunklist")
+	}
+	return chunks, nil
+}
+
+// parseChunklist parses the m3u8 playlist, resolving URLs relative to base.
+func parseChunklist(r io.Reader, base string) ([]chunk, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid playlist URL: %w", err)
+	}
+	var (
+		chunks  []chunk
+		pending chunk
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			sec, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if f, err := strconv.ParseFloat(sec, 64); err == nil {
+				pending.Duration = time.Duration(f * float64(time.Second))
+			}
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"):
+			if t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:")); err == nil {
+				pending.Time = t
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			u, err := baseURL.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid chunk URL %s: %w", line, err)
+			}
+			pending.URL = u.String()
+			chunks = append(chunks, pending)
+			pending = chunk{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read playlist: %w", err)
+	}
+	return chunks, nil
+}
+
+// checkGaps returns errChunklistGap if a chunk doesn't start at the end of the previous one,
+// or the chunks start after start or end before end, which truncates the recording.
+func checkGaps(chunks []chunk, start, end time.Time) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	if first := chunks[0]; !first.Time.IsZero() && first.Time.Sub(start) > gapTolerance {
+		return fmt.Errorf("%w: missing %s to %s", errChunklistGap, start.In(JST).Format(time.TimeOnly), first.Time.In(JST).Format(time.TimeOnly))
+	}
+	if last := chunks[len(chunks)-1]; !last.Time.IsZero() && last.Duration > 0 {
+		if lastEnd := last.Time.Add(last.Duration); end.Sub(lastEnd) > gapTolerance {
+			return fmt.Errorf("%w: missing %s to %s", errChunklistGap, lastEnd.In(JST).Format(time.TimeOnly), end.In(JST).Format(time.TimeOnly))
+		}
+	}
+	for i := 1; i < len(chunks); i++ {
+		prev, cur := chunks[i-1], chunks[i]
+		if prev.Time.IsZero() || cur.Time.IsZero() {
+			continue
+		}
+		if end := prev.Time.Add(prev.Duration); cur.Time.Sub(end) > gapTolerance {
+			return fmt.Errorf("%w: missing %s to %s", errChunklistGap, end.In(JST).Format(time.TimeOnly), cur.Time.In(JST).Format(time.TimeOnly))
+		}
+	}
+	return nil
+}
+
+// bulkDownload downloads chunks into dirPath and returns their paths in order.
+// Chunks already downloaded and valid, by an earlier attempt of the job, are skipped.
+func (d *downloader) bulkDownload(ctx context.Context, logger *slog.Logger, chunks []chunk, dirPath string) ([]string, error) {
+	paths := make([]string, len(chunks))
+	var skipped atomic.Int64
+	g, ctx := errgroup.WithContext(ctx)
+	for i, c := range chunks {
+		c := c
+		path := filepath.Join(dirPath, fmt.Sprintf("%05d.aac", i))
+		paths[i] = path
+		if data, err := os.ReadFile(path); err == nil && validateChunk(data, c.Duration) == nil {
+			skipped.Add(1)
+			continue
+		}
+		g.Go(func() error {
+			if err := d.sem.Acquire(ctx, 1); err != nil {
+				return fmt.Errorf("failed to acquire semaphore: %w", err)
+			}
+			defer d.sem.Release(1)
+			return d.downloadWithRetry(ctx, c, path)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	logger.Debug("downloaded chunks", "total", len(chunks), "skipped", skipped.Load())
+	return paths, nil
+}
+
+// downloadWithRetry downloads the chunk into path, retried up to maxAttempts times with exponential backoff.
+func (d *downloader) downloadWithRetry(ctx context.Context, c chunk, path string) error {
+	var err error
+	for attempts := 1; attempts <= d.maxAttempts; attempts++ {
+		if attempts > 1 {
+			select {
+			case <-time.After(d.retryBackoff << (attempts - 2)):
+			case <-ctx.Done():
+				return fmt.Errorf("failed to download %s: %w", c.URL, ctx.Err())
+			}
+		}
+		if err = d.download(ctx, c, path); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to download %s: %w", c.URL, err)
+}
+
+// download downloads the chunk into path after validating it, so that path holds only a valid chunk.
+func (d *downloader) download(ctx context.Context, c chunk, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !chunkContentType(contentType) {
+		return fmt.Errorf("unexpected content type: %s", contentType)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxChunkBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxChunkBytes {
+		return fmt.Errorf("too large chunk over %d bytes", maxChunkBytes)
+	}
+	if resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength {
+		return fmt.Errorf("truncated chunk of %d bytes, expected %d", len(data), resp.ContentLength)
+	}
+	if err := validateChunk(data, c.Duration); err != nil {
+		return err
+	}
+
+	partPath := path + ".part"
+	if err := os.WriteFile(partPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(partPath, path)
+}
+
+// chunkContentType reports whether the content type may be of AAC chunks. Servers may omit it.
+func chunkContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "audio/") || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream"
+}
@@ -0,0 +1,133 @@
+package radiko
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+func TestParseChunklist(t *testing.T) {
+	f, err := os.Open("testdata/v1cA1fcZ.m3u8")
+	require.NoError(t, err)
+	defer f.Close()
+	chunks, err := parseChunklist(f, "https://radiko.jp/v2/api/ts/chunklist/v1cA1fcZ.m3u8")
+	require.NoError(t, err)
+	require.Len(t, chunks, 5)
+	assert.Equal(t, "https://media.radiko.jp/sound/b/LFR/20231015/20231015_010000_5kTKg.aac", chunks[0].URL)
+	assert.True(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST).Equal(chunks[0].Time))
+	assert.Equal(t, 5*time.Second, chunks[0].Duration)
+	start := time.Date(2023, 10, 15, 1, 0, 0, 0, JST)
+	end := start.Add(25 * time.Second)
+	assert.NoError(t, checkGaps(chunks, start, end))
+
+	t.Run("gap", func(t *testing.T) {
+		gapped := append(append([]chunk{}, chunks[:2]...), chunks[3:]...)
+		assert.ErrorIs(t, checkGaps(gapped, start, end), errChunklistGap)
+	})
+	t.Run("late start", func(t *testing.T) {
+		assert.ErrorIs(t, checkGaps(chunks[1:], start, end), errChunklistGap)
+	})
+	t.Run("early end", func(t *testing.T) {
+		assert.ErrorIs(t, checkGaps(chunks[:4], start, end), errChunklistGap)
+	})
+}
+
+func TestBulkDownload(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	sample := httpmock.File("testdata/chunk.aac").Bytes()
+	audioHeader := http.Header{"Content-Type": {"audio/aac"}}
+	httpmock.RegisterResponder("GET", "https://media.radiko.jp/0.aac",
+		httpmock.NewBytesResponder(http.StatusOK, sample).HeaderSet(audioHeader))
+	httpmock.RegisterResponder("GET", "https://media.radiko.jp/1.aac",
+		httpmock.NewBytesResponder(http.StatusOK, sample).HeaderSet(audioHeader))
+	httpmock.RegisterResponder("GET", "https://media.radiko.jp/forbidden.aac",
+		httpmock.NewStringResponder(http.StatusForbidden, "<html>forbidden</html>").HeaderSet(http.Header{"Content-Type": {"text/html"}}))
+	httpmock.RegisterResponder("GET", "https://media.radiko.jp/html.aac",
+		httpmock.NewStringResponder(http.StatusOK, "<html>maintenance</html>").HeaderSet(http.Header{"Content-Type": {"text/html"}}))
+	httpmock.RegisterResponder("GET", "https://media.radiko.jp/short.aac",
+		httpmock.NewBytesResponder(http.StatusOK, sample[:len(sample)/3]).HeaderSet(audioHeader))
+
+	ctx := context.Background()
+	dl := &downloader{client: http.DefaultClient, sem: semaphore.NewWeighted(2), maxAttempts: 2}
+	chunks := []chunk{
+		{URL: "https://media.radiko.jp/0.aac", Duration: 5 * time.Second},
+		{URL: "https://media.radiko.jp/1.aac", Duration: 5 * time.Second},
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "00000.aac"), sample, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "00001.aac"), []byte("broken"), 0644))
+		httpmock.ZeroCallCounters()
+
+		paths, err := dl.bulkDownload(ctx, slog.Default(), chunks, dir)
+		require.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "00000.aac"), filepath.Join(dir, "00001.aac")}, paths)
+		info := httpmock.GetCallCountInfo()
+		assert.Equal(t, 0, info["GET https://media.radiko.jp/0.aac"])
+		assert.Equal(t, 1, info["GET https://media.radiko.jp/1.aac"])
+		data, err := os.ReadFile(paths[1])
+		require.NoError(t, err)
+		assert.Equal(t, sample, data)
+	})
+
+	for _, name := range []string{"forbidden", "html", "short"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := dl.bulkDownload(ctx, slog.Default(), []chunk{
+				{URL: "https://media.radiko.jp/" + name + ".aac", Duration: 5 * time.Second},
+			}, dir)
+			assert.Error(t, err)
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			for _, e := range entries {
+				assert.False(t, strings.HasSuffix(e.Name(), ".aac"), "invalid chunk %s is saved", e.Name())
+			}
+		})
+	}
+}
+
+func TestDownloader_SharedConcurrency(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	sample := httpmock.File("testdata/chunk.aac").Bytes()
+	var running, maxRunning atomic.Int32
+	httpmock.RegisterResponder("GET", `=~^https://media\.radiko\.jp/[0-9]\.aac$`,
+		func(req *http.Request) (*http.Response, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for m := maxRunning.Load(); n > m && !maxRunning.CompareAndSwap(m, n); m = maxRunning.Load() {
+			}
+			time.Sleep(10 * time.Millisecond)
+			return httpmock.NewBytesResponse(http.StatusOK, sample), nil
+		})
+
+	// jobs sharing the downloader download a chunk at a time in total
+	dl := newDownloader(http.DefaultClient, config.HTTP{Concurrency: 1})
+	var g errgroup.Group
+	for job := 0; job < 3; job++ {
+		g.Go(func() error {
+			chunks := []chunk{{URL: "https://media.radiko.jp/0.aac"}, {URL: "https://media.radiko.jp/1.aac"}}
+			_, err := dl.bulkDownload(context.Background(), slog.Default(), chunks, t.TempDir())
+			return err
+		})
+	}
+	require.NoError(t, g.Wait())
+	assert.Equal(t, int32(1), maxRunning.Load())
+}
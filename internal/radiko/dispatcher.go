@@ -4,44 +4,81 @@ import (
 	"context"
 	"log/slog"
 	"math"
+	"slices"
 	"time"
 )
 
-func RunDispatcher(ctx context.Context, toDispatcher <-chan []Schedule, toFetcher chan<- Schedule) {
+// RunDispatcher sends schedules to fetchers at their fetch time.
+// Schedules from the planner replace the previous ones, while schedules to retry are kept until dispatched.
+// The returned channel is closed when the dispatcher stops.
+func RunDispatcher(ctx context.Context, toDispatcher <-chan []Schedule, toRetry <-chan Schedule, toFetcher chan<- Job, store *JobStore) <-chan struct{} {
 	logger := slog.Default().With("job", "dispatcher")
 	logger.Debug("start dispatcher")
-	sches := <-toDispatcher
+	done := make(chan struct{})
+	var sches []Schedule
+	select {
+	case sches = <-toDispatcher:
+	case <-ctx.Done():
+		close(done)
+		return done
+	}
+	var retries []Schedule
 	nextDispatchDuration := func() time.Duration {
+		d := time.Duration(math.MaxInt64)
 		if len(sches) > 0 {
-			return sches[0].FetchTime.Sub(time.Now())
-		} else {
-			return math.MaxInt64
+			d = min(d, sches[0].FetchTime.Sub(time.Now()))
+		}
+		if len(retries) > 0 {
+			d = min(d, retries[0].FetchTime.Sub(time.Now()))
 		}
+		return d
+	}
+	dispatch := func(ss []Schedule) []Schedule {
+		for len(ss) > 0 {
+			if ss[0].FetchTime.Before(time.Now()) || ss[0].FetchTime.Equal(time.Now()) {
+				logger.Debug("dispatch", "schedule", ss[0])
+				job, err := store.Enqueue(ss[0])
+				if err != nil {
+					logger.Error("failed to enqueue job", "error", err)
+				}
+				select {
+				case toFetcher <- job:
+				case <-ctx.Done():
+					return ss
+				}
+				ss = ss[1:]
+			} else {
+				break
+			}
+		}
+		return ss
 	}
 
 	go func() {
+		defer close(done)
 		timer := time.NewTimer(nextDispatchDuration())
 		for {
 			select {
 			case <-timer.C:
 				logger.Debug("dispatch start")
-				for len(sches) > 0 {
-					if sches[0].FetchTime.Before(time.Now()) || sches[0].FetchTime.Equal(time.Now()) {
-						logger.Debug("dispatch", "schedule", sches[0])
-						toFetcher <- sches[0]
-						sches = sches[1:]
-					} else {
-						break
-					}
-				}
+				sches = dispatch(sches)
+				retries = dispatch(retries)
 				timer.Reset(nextDispatchDuration())
 			case sches = <-toDispatcher:
 				logger.Debug("receive new schedules", "schedules", sches)
 				timer.Reset(nextDispatchDuration())
+			case retry := <-toRetry:
+				logger.Debug("receive schedule to retry", "schedule", retry)
+				retries = append(retries, retry)
+				slices.SortFunc(retries, func(a, b Schedule) int {
+					return a.FetchTime.Compare(b.FetchTime)
+				})
+				timer.Reset(nextDispatchDuration())
 			case <-ctx.Done():
 				logger.Debug("stop dispatcher")
 				return
 			}
 		}
 	}()
+	return done
 }
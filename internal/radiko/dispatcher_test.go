@@ -0,0 +1,50 @@
+package radiko
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunDispatcher_ResumedRetry(t *testing.T) {
+	store, err := OpenJobStore(JobStorePath(t.TempDir()))
+	require.NoError(t, err)
+
+	now := time.Now()
+	retry := Schedule{StationID: LFR, StartTime: now.Add(-time.Hour).Truncate(time.Minute), FetchTime: now.Add(500 * time.Millisecond)}
+	job, err := store.Enqueue(retry)
+	require.NoError(t, err)
+	job.Attempts = 1
+	require.NoError(t, store.Save(&job))
+	jobs, err := store.Unfinished()
+	require.NoError(t, err)
+	sches, retries := resumedSchedules(jobs, now)
+	require.Empty(t, sches)
+	require.Len(t, retries, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	toDispatcher := make(chan []Schedule)
+	toRetry := make(chan Schedule)
+	toFetcher := make(chan Job)
+	// the dispatcher waits for the first schedules to start
+	go func() { toDispatcher <- sches }()
+	done := RunDispatcher(ctx, toDispatcher, toRetry, toFetcher, store)
+
+	toRetry <- retries[0]
+	// the next schedules of the planner do not replace the retry
+	toDispatcher <- []Schedule{{StationID: TBS, StartTime: now.Add(time.Hour), FetchTime: now.Add(7 * time.Hour)}}
+
+	select {
+	case got := <-toFetcher:
+		assert.Equal(t, job.ID, got.ID)
+		assert.Equal(t, 1, got.Attempts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the resumed retry was not dispatched")
+	}
+	cancel()
+	<-done
+}
@@ -1,8 +1,10 @@
 package radiko
 
 import (
+	"bufio"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -10,227 +12,524 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/abekoh/radiko-archiver/internal/audio"
 	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/library"
 	goradiko "github.com/yyoshiki41/go-radiko"
-	"golang.org/x/sync/errgroup"
-	"golang.org/x/sync/semaphore"
 )
 
-func RunFetchers(ctx context.Context, toFetcher <-chan Schedule, cnf *config.Config, toDone chan<- bool) {
+// RunFetchers fetches and converts jobs from toFetcher.
+// Failed jobs are sent to toRetry with backoff if it is not nil, and finished jobs are sent to toDone if it is not nil.
+// When ctx is done, running jobs are given the shutdown grace period to finish, and then aborted.
+// The returned channel is closed when all jobs are finished or aborted.
+func RunFetchers(ctx context.Context, toFetcher <-chan Job, cnf *config.Config, store *JobStore, httpClient *http.Client, toRetry chan<- Schedule, toDone chan<- Job) <-chan struct{} {
 	logger := slog.Default().With("job", "fetchers")
 	logger.Debug("start fetchers")
 
-	radikoClient, err := goradiko.New("")
+	defaultProfile, err := outputProfile(cnf.Output.Format, cnf.Output.Bitrate, audio.Profile{Format: audio.AAC})
+	if err != nil {
+		panic(fmt.Errorf("invalid output config: %w", err))
+	}
+	namer, err := library.NewNamer(cnf.Output.Filename)
+	if err != nil {
+		panic(fmt.Errorf("invalid output config: %w", err))
+	}
+	// slots limit running jobs, not to download and transcode all of backfilled and resumed jobs at once
+	slots := make(chan struct{}, cnf.Radiko.MaxJobs)
+
+	radikoClient, err := newRadikoClient(httpClient)
 	if err != nil {
 		panic(fmt.Errorf("failed to create radiko client: %w", err))
 	}
+	auth := newAuthorizer(radikoClient, cnf.Radiko.Mail, cnf.Radiko.Password)
+	// without premium, radiko authorizes the area by the IP address, so stations outside it cannot be fetched
+	if !auth.premium() && cnf.Radiko.AreaID != "" && cnf.Radiko.AreaID != auth.area {
+		logger.Warn("area_id differs from the authorized area, stations outside the authorized area cannot be fetched without premium",
+			"areaID", cnf.Radiko.AreaID, "authorizedArea", auth.area)
+	}
+	dl := newDownloader(httpClient, cnf.HTTP)
+
+	// shutdown is kept apart from ctx of each job, to stop sending to the dispatcher once it has stopped
+	shutdown := ctx.Done()
+	// running jobs are not canceled by ctx, but by abort after the grace period
+	abortCtx, abort := context.WithCancel(context.WithoutCancel(ctx))
+	var wg sync.WaitGroup
+	done := make(chan struct{})
 
 	go func() {
+		defer close(done)
+		defer abort()
 		for {
 			select {
-			case sche := <-toFetcher:
-				c, cancel := context.WithTimeout(ctx, fetchTimeout)
-				defer cancel()
-				go func(ctx context.Context, s Schedule) {
+			case job := <-toFetcher:
+				wg.Add(1)
+				go func(job Job) {
+					defer wg.Done()
+					s := job.Schedule
+					profile := s.Profile
+					if profile.Format == "" {
+						profile = defaultProfile
+					}
 					log := slog.Default().With("job", fmt.Sprintf("fetcher-%s-%s", s.StationID, s.StartTime.Format("20060102150405")))
+					if !s.Live {
+						// live recordings start on time, and the others wait for a free slot
+						select {
+						case slots <- struct{}{}:
+							defer func() { <-slots }()
+						case <-shutdown:
+							// the queued job is resumed on the next start
+							log.Info("not started by shutdown")
+							if toDone != nil {
+								toDone <- job
+							}
+							return
+						}
+					}
+					timeout := s.FetchTimeout
+					if timeout <= 0 {
+						timeout = cnf.Radiko.FetchTimeout
+					}
+					ctx, cancel := context.WithTimeout(abortCtx, timeout)
+					defer cancel()
 
-					workingDirPath, err := os.MkdirTemp("", "radiko-archiver-*")
-					if err != nil {
-						log.Error("failed to create temp dir", "error", err)
-						toDone <- false
+					setState := func(state JobState, err error) {
+						job.State = state
+						if err != nil {
+							job.Error = err.Error()
+						}
+						if err := store.Save(&job); err != nil {
+							log.Error("failed to save job", "error", err)
+						}
+					}
+					// outputs are staged in the working directory of the job, which is kept with downloaded chunks
+					// while the job is to be retried or resumed, and removed when the job is finished
+					workingDirPath := jobStagingDir(cnf.OutDirPath, job.ID)
+					chunksDirPath := filepath.Join(workingDirPath, "chunks")
+					defer func() {
+						if job.State == JobFailed && abortCtx.Err() != nil {
+							// aborted by shutdown, to be resumed on the next start without using up an attempt
+							log.Info("aborted")
+							job.Attempts--
+							setState(JobQueued, nil)
+						} else if job.State == JobFailed && toRetry != nil && !s.Live && !job.Permanent {
+							// live recordings cannot be retried after the broadcast, and tolerate errors while recording
+							if retryTime, ok := job.NextRetryTime(time.Now(), cnf.Radiko.MaxAttempts); ok {
+								log.Info("retry later", "attempts", job.Attempts, "retryTime", retryTime)
+								job.Schedule.FetchTime = retryTime
+								setState(JobQueued, nil)
+								select {
+								case toRetry <- job.Schedule:
+								case <-shutdown:
+									// the dispatcher has stopped, and the queued job is resumed on the next start
+								case <-abortCtx.Done():
+								}
+								return
+							}
+						}
+						if job.State == JobFailed && s.Live && hasChunks(chunksDirPath) {
+							// the broadcast cannot be recorded again, and the recorded chunks are left to be salvaged
+							log.Warn("keep recorded chunks", "dir", chunksDirPath)
+						} else if job.Finished() {
+							_ = os.RemoveAll(workingDirPath)
+						}
+						if toDone != nil {
+							toDone <- job
+						}
+					}()
+
+					job.Attempts++
+					job.Error = ""
+					setState(JobFetching, nil)
+
+					if err := prepareStaging(workingDirPath, chunksDirPath); err != nil {
+						log.Error("failed to prepare working dir", "error", err)
+						setState(JobFailed, err)
 						return
 					}
 
-					pg, err := fetch(ctx, log, s, radikoClient, cnf.OutDirPath, workingDirPath)
+					var (
+						pg         *goradiko.Prog
+						meta       programMeta
+						chunkPaths []string
+						err        error
+					)
+					if s.Live {
+						// recording lasts until the end of the broadcast, and the timeout is given to converting after it
+						pg, meta, chunkPaths, err = recordLive(abortCtx, log, s, auth, dl, workingDirPath, chunksDirPath)
+						ctx, cancel = context.WithTimeout(abortCtx, timeout)
+						defer cancel()
+					} else {
+						pg, meta, chunkPaths, err = fetch(ctx, log, s, auth, dl, workingDirPath, chunksDirPath)
+					}
 					if err != nil {
 						log.Error("failed to fetch", "error", err)
-						toDone <- false
+						// the station is not available until the area changes, and retries fail the same
+						job.Permanent = errors.Is(err, errStationNotAvailable)
+						setState(JobFailed, err)
 						return
 					}
 
-					if err := convert(ctx, log, s, pg, cnf.OutDirPath, workingDirPath); err != nil {
+					tags := episodeTags(ctx, log, s, pg, meta, httpClient)
+
+					setState(JobConverting, nil)
+					if err := convert(ctx, log, pg, profile, tags, workingDirPath, chunkPaths); err != nil {
 						log.Error("failed to convert", "error", err)
-						toDone <- false
+						setState(JobFailed, err)
+						return
+					}
+
+					name, err := namer.Name(library.Episode{
+						Rule:      s.RuleName,
+						StationID: string(s.StationID),
+						Station:   tags.Album,
+						Title:     pg.Title,
+						Pfm:       pg.Pfm,
+						Start:     s.StartTime.In(JST),
+					})
+					if err != nil {
+						log.Error("failed to name episode", "error", err)
+						setState(JobFailed, err)
+						return
+					}
+					if err := commitEpisode(workingDirPath, cnf.OutDirPath, name, profile.Format); err != nil {
+						log.Error("failed to commit", "error", err)
+						setState(JobFailed, err)
 						return
 					}
+					job.Name = name
 
-					toDone <- true
-				}(c, sche)
+					setState(JobDone, nil)
+				}(job)
 			case <-ctx.Done():
+				logger.Info("stop fetchers, waiting for running jobs")
+				waited := make(chan struct{})
+				go func() {
+					wg.Wait()
+					close(waited)
+				}()
+				select {
+				case <-waited:
+				case <-time.After(cnf.Radiko.ShutdownGracePeriod):
+					logger.Warn("grace period exceeded, abort running jobs")
+					abort()
+					<-waited
+				}
 				logger.Debug("stop fetchers")
 				return
 			}
 		}
 	}()
+	return done
 }
 
-const (
-	maxAttempts    = 3
-	maxConcurrents = 64
-)
+// episodePath returns the path of the output file of the episode named by the template with ext.
+func episodePath(outDirPath, name, ext string) string {
+	return filepath.Join(outDirPath, filepath.FromSlash(name)+ext)
+}
 
-func fetch(ctx context.Context, logger *slog.Logger, s Schedule, radikoClient *goradiko.Client, outDirPath string, workingDirPath string) (*goradiko.Prog, error) {
-	logger.Info("start fetching", "schedule", s)
+// stagingName is the name of outputs in working directories, which are renamed by the template on commit.
+const stagingName = "episode"
+
+// stagingDirPrefix is the prefix of working directories in the output directory.
+// They are dotfiles, not to be published by the feed and the Dropbox syncer.
+const stagingDirPrefix = ".staging-"
 
-	_, err := radikoClient.AuthorizeToken(ctx)
+// jobStagingDir returns the working directory of the job, which is the same across attempts.
+func jobStagingDir(outDirPath, jobID string) string {
+	return filepath.Join(outDirPath, stagingDirPrefix+jobID)
+}
+
+// prepareStaging creates the working directory and its chunks directory,
+// removing outputs of an earlier attempt but keeping downloaded chunks.
+func prepareStaging(stagingDirPath, chunksDirPath string) error {
+	if err := os.MkdirAll(chunksDirPath, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(stagingDirPath)
 	if err != nil {
-		panic(fmt.Errorf("failed to authorize token: %w", err))
+		return err
+	}
+	for _, e := range entries {
+		if path := filepath.Join(stagingDirPath, e.Name()); path != chunksDirPath {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	pg, err := radikoClient.GetProgramByStartTime(ctx, string(s.StationID), s.StartTime)
+// hasChunks reports whether any chunk is downloaded into chunksDirPath.
+func hasChunks(chunksDirPath string) bool {
+	paths, err := recordedChunks(chunksDirPath)
+	return err == nil && len(paths) > 0
+}
+
+// commitEpisode moves the staged outputs into outDirPath as name.
+// The metadata is moved last, as the marker that the episode is complete.
+func commitEpisode(stagingDirPath, outDirPath, name string, format audio.Format) error {
+	audioPath := episodePath(outDirPath, name, format.Ext())
+	if err := os.MkdirAll(filepath.Dir(audioPath), 0755); err != nil {
+		return fmt.Errorf("failed to create dir: %w", err)
+	}
+	if err := os.Rename(episodePath(stagingDirPath, stagingName, format.Ext()), audioPath); err != nil {
+		return fmt.Errorf("failed to move audio: %w", err)
+	}
+	chaptersPath := episodePath(outDirPath, name, audio.ChaptersExt)
+	if err := os.Rename(episodePath(stagingDirPath, stagingName, audio.ChaptersExt), chaptersPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		_ = os.Remove(audioPath)
+		return fmt.Errorf("failed to move chapters: %w", err)
+	}
+	if err := os.Rename(episodePath(stagingDirPath, stagingName, ".xml"), episodePath(outDirPath, name, ".xml")); err != nil {
+		_ = os.Remove(audioPath)
+		_ = os.Remove(chaptersPath)
+		return fmt.Errorf("failed to move metadata: %w", err)
+	}
+	return nil
+}
+
+// removeStaging removes working directories left by a process killed while fetching,
+// except ones of unfinished jobs to be resumed and failed live recordings with their chunks.
+func removeStaging(outDirPath string, store *JobStore) error {
+	jobs, err := store.List(func(job Job) bool {
+		return !job.Finished() || job.State == JobFailed && job.Schedule.Live
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch program: %w", err)
+		return err
 	}
-	logger.Debug("get program", "program", pg)
+	paths, err := filepath.Glob(filepath.Join(outDirPath, stagingDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if slices.ContainsFunc(jobs, func(job Job) bool { return jobStagingDir(outDirPath, job.ID) == path }) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	xmlFile, err := os.Create(fmt.Sprintf("%s/%s_%s_%s.xml", outDirPath, pg.Ft, s.StationID, pg.Title))
+// fetch fetches the program, writes its metadata into stagingDirPath and downloads its chunks into chunksDirPath.
+// It returns the program, its metadata and paths of the chunks in order.
+// The station must broadcast in the area which radiko authorized, unless the premium member is area-free.
+func fetch(ctx context.Context, logger *slog.Logger, s Schedule, auth *authorizer, dl *downloader, stagingDirPath, chunksDirPath string) (*goradiko.Prog, programMeta, []string, error) {
+	logger.Info("start fetching", "schedule", s)
+
+	areaID, token, err := auth.authorize(ctx)
 	if err != nil {
-		logger.Error("failed to create file", "error", err)
-		return nil, fmt.Errorf("failed to create file: %w", err)
+		return nil, programMeta{}, nil, err
 	}
-	defer xmlFile.Close()
-	xmlEncoder := xml.NewEncoder(xmlFile)
-	xmlEncoder.Indent("", "  ")
-	if err := xmlEncoder.Encode(pg); err != nil {
-		return nil, fmt.Errorf("failed to encode xml: %w", err)
+	radikoClient := auth.client
+
+	pg, meta, err := fetchProgram(ctx, radikoClient, areaID, s)
+	if errors.Is(err, errStationNotAvailable) {
+		return nil, programMeta{}, nil, err
+	} else if err != nil {
+		return nil, programMeta{}, nil, fmt.Errorf("failed to fetch program: %w", err)
 	}
+	logger.Debug("get program", "program", pg)
 
-	m3u8URI, err := radikoClient.TimeshiftPlaylistM3U8(ctx, string(s.StationID), s.StartTime)
+	endTime, err := s.endTime(pg)
+	if err != nil {
+		return nil, programMeta{}, nil, fmt.Errorf("invalid end time of program: %w", err)
+	}
+	if err := writeProgXML(stagingDirPath, pg, s.StartTime, endTime); err != nil {
+		return nil, programMeta{}, nil, err
+	}
+	m3u8URI, err := timeshiftPlaylistURL(ctx, radikoClient, token, s.StationID, s.StartTime, endTime)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get m3u8URI: %w", err)
+		return nil, programMeta{}, nil, fmt.Errorf("failed to get m3u8URI: %w", err)
 	}
 	logger.Debug("got m3u8URI", "m3u8URI", m3u8URI)
 
-	chunkList, err := goradiko.GetChunklistFromM3U8(m3u8URI)
+	chunks, err := dl.fetchChunklist(ctx, m3u8URI, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get chunkList: %w", err)
+		return nil, programMeta{}, nil, fmt.Errorf("failed to get chunklist: %w", err)
 	}
-	logger.Debug("got chunkList", "chunkList[:5]", chunkList[:5], "len()", len(chunkList))
+	if err := checkGaps(chunks, s.StartTime, endTime); err != nil {
+		return nil, programMeta{}, nil, err
+	}
+	logger.Debug("got chunklist", "len", len(chunks))
 
-	logger.Debug("workingDirPath", "workingDirPath", workingDirPath)
-	if err := bulkDownload(
-		ctx,
-		chunkList,
-		workingDirPath,
-		string(s.StationID)+s.StartTime.Format("20060102150405")+"_",
-	); err != nil {
-		return nil, fmt.Errorf("failed to download chunks: %w", err)
+	chunkPaths, err := dl.bulkDownload(ctx, logger, chunks, chunksDirPath)
+	if err != nil {
+		return nil, programMeta{}, nil, fmt.Errorf("failed to download chunks: %w", err)
 	}
 	logger.Debug("complete downloading chunks")
 
 	logger.Info("finish fetching")
 
-	return pg, nil
+	return pg, meta, chunkPaths, nil
 }
 
-func bulkDownload(ctx context.Context, urls []string, outDirPath, fileNamePrefix string) error {
-	sem := semaphore.NewWeighted(maxConcurrents)
-	g, ctx := errgroup.WithContext(ctx)
-	for _, url := range urls {
-		url := url
-		g.Go(func() error {
-			if err := sem.Acquire(ctx, 1); err != nil {
-				return fmt.Errorf("failed to acquire semaphore: %w", err)
-			}
-			defer sem.Release(1)
-
-			attempts := 0
-			for {
-				attempts++
-				_, urlFilename := filepath.Split(url)
-				if err := download(ctx, url, outDirPath, fileNamePrefix+urlFilename); err != nil {
-					if attempts >= maxAttempts {
-						return fmt.Errorf("failed to download: %w", err)
-					}
-				} else {
-					break
-				}
-			}
-			return nil
-		})
-	}
-	if err := g.Wait(); err != nil {
-		return fmt.Errorf("failed to download one job: %w", err)
+// timeshiftPlaylistURL returns the URL of the chunklist of the time-shifted audio from start until end,
+// which may be a part of the program or span several programs. It is requested with the authorized token.
+func timeshiftPlaylistURL(ctx context.Context, radikoClient *goradiko.Client, token string, stationID StationID, start, end time.Time) (string, error) {
+	u := *radikoClient.URL
+	u.Path = path.Join(u.Path, "v2/api/ts/playlist.m3u8")
+	q := u.Query()
+	q.Set("station_id", string(stationID))
+	q.Set("ft", start.In(JST).Format("20060102150405"))
+	q.Set("to", end.In(JST).Format("20060102150405"))
+	q.Set("l", "15")
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return "", err
 	}
-	return nil
-}
-
-func download(ctx context.Context, url, outDirPath, filename string) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req.Header.Set("X-Radiko-AuthToken", token)
+	resp, err := radikoClient.Do(req)
 	if err != nil {
-		return err
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	// the playlist lists the chunklist of the audio
+	variants, err := parseChunklist(resp.Body, u.String())
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer func() {
-		_ = resp.Body.Close()
-	}()
+	if len(variants) == 0 {
+		return "", errors.New("empty playlist")
+	}
+	return variants[0].URL, nil
+}
 
-	file, err := os.Create(filepath.Join(outDirPath, filename))
+// writeProgXML writes the program recorded from start to end into the staging directory.
+func writeProgXML(stagingDirPath string, pg *goradiko.Prog, start, end time.Time) error {
+	prog := recordedProg(pg, start, end)
+	err := writeFile(episodePath(stagingDirPath, stagingName, ".xml"), func(w io.Writer) error {
+		xmlEncoder := xml.NewEncoder(w)
+		xmlEncoder.Indent("", "  ")
+		return xmlEncoder.Encode(prog)
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to write xml: %w", err)
 	}
-	defer func() {
-		_ = file.Close()
-	}()
+	return nil
+}
 
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return err
+// recordedProg returns the program with the times of the recording, which may be a part of the program or span several.
+// ftl and tol are in the notation of radio listings like "2500", and dur is in seconds.
+func recordedProg(pg *goradiko.Prog, start, end time.Time) goradiko.Prog {
+	prog := *pg
+	day := broadcastDay(start)
+	prog.Ft = start.In(JST).Format("20060102150405")
+	prog.To = end.In(JST).Format("20060102150405")
+	prog.Ftl = listingClock(start.Sub(day))
+	prog.Tol = listingClock(end.Sub(day))
+	prog.Dur = strconv.Itoa(int(end.Sub(start).Seconds()))
+	return prog
+}
+
+// listingClock formats the time since the beginning of the day like "2500".
+func listingClock(d time.Duration) string {
+	return fmt.Sprintf("%02d%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// archived reports whether the episode of the schedule already exists in outDirPath.
+// The metadata is checked, as it is committed last. Episodes without jobs are looked up in items of the library
+// by the default name, in any subdirectory.
+func archived(store *JobStore, outDirPath string, items []library.Item, s Schedule) bool {
+	if job, err := store.Get(s.ID()); err == nil && job.State == JobDone && job.Name != "" {
+		if _, err := os.Stat(episodePath(outDirPath, job.Name, ".xml")); err == nil {
+			return true
+		}
 	}
-	return err
+	prefix := fmt.Sprintf("%s_%s_", s.StartTime.In(JST).Format("20060102150405"), s.StationID)
+	return slices.ContainsFunc(items, func(item library.Item) bool {
+		return item.Start.Equal(s.StartTime) && strings.HasPrefix(path.Base(item.Name), prefix)
+	})
 }
 
-func convert(ctx context.Context, logger *slog.Logger, s Schedule, pg *goradiko.Prog, outDirPath string, workingDirPath string) error {
+// convert concatenates the chunks into the audio in stagingDirPath, and transcodes it by the profile.
+// The tags are written as ID3 for AAC, or passed to ffmpeg for the other formats.
+func convert(ctx context.Context, logger *slog.Logger, pg *goradiko.Prog, profile audio.Profile, tags audio.Tags, stagingDirPath string, chunkPaths []string) error {
 	logger.Info("start converting", "program", pg)
-	tempResourcesFile, err := os.CreateTemp(workingDirPath, "resources_*.txt")
+
+	concatFilePath := episodePath(stagingDirPath, stagingName, audio.AAC.Ext())
+	concatFile, err := os.Create(concatFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to create resources file: %w", err)
+		return fmt.Errorf("failed to create file: %w", err)
 	}
-	defer func() {
-		_ = os.Remove(tempResourcesFile.Name())
-	}()
-	var aacFilePaths []string
-	if err := filepath.WalkDir(workingDirPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return nil
+	defer concatFile.Close()
+	w := bufio.NewWriter(concatFile)
+	if !profile.Format.Transcoded() {
+		if err := audio.WriteID3(w, tags); err != nil {
+			return fmt.Errorf("failed to write tags: %w", err)
 		}
-		if d.IsDir() {
-			return nil
-		}
-		if filepath.Ext(path) == ".aac" {
-			aacFilePaths = append(aacFilePaths, path)
-		}
-		return nil
-	}); err != nil {
-		return fmt.Errorf("failed to walk tempDir: %w", err)
-	}
-	slices.Sort(aacFilePaths)
-
-	for _, aacFilePath := range aacFilePaths {
-		tempResourcesFile.WriteString("file '" + aacFilePath + "'\n")
-	}
-	tempResourcesFile.Close()
-
-	concatFilePath := filepath.Join(outDirPath, fmt.Sprintf("%s_%s_%s.aac", pg.Ft, s.StationID, pg.Title))
-	cmd := exec.CommandContext(
-		ctx,
-		"ffmpeg",
-		"-f", "concat",
-		"-safe", "0",
-		"-y",
-		"-i", tempResourcesFile.Name(),
-		"-c", "copy",
-		concatFilePath,
-	)
-	if err := cmd.Run(); err != nil {
+	}
+	if err := concatADTS(w, chunkPaths); err != nil {
 		return fmt.Errorf("failed to concat aac files: %w", err)
 	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write aac file: %w", err)
+	}
+	if err := concatFile.Close(); err != nil {
+		return fmt.Errorf("failed to close aac file: %w", err)
+	}
 	logger.Debug("complete concat aac files")
+
+	if len(tags.Chapters) > 0 {
+		if err := writeFile(episodePath(stagingDirPath, stagingName, audio.ChaptersExt), func(w io.Writer) error {
+			return audio.WriteChaptersJSON(w, tags.Chapters)
+		}); err != nil {
+			return fmt.Errorf("failed to write chapters: %w", err)
+		}
+	}
+
+	if !profile.Format.Transcoded() {
+		return ctx.Err()
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("ffmpeg is required to transcode into %s: %w", profile.Format, err)
+	}
+	metadataPath := filepath.Join(stagingDirPath, "metadata.txt")
+	if err := writeFile(metadataPath, func(w io.Writer) error {
+		return audio.WriteFFMetadata(w, tags)
+	}); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	var coverPath string
+	if len(tags.Cover) > 0 {
+		coverPath = filepath.Join(stagingDirPath, "cover")
+		if err := os.WriteFile(coverPath, tags.Cover, 0644); err != nil {
+			return fmt.Errorf("failed to write cover: %w", err)
+		}
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", profile.FFmpegArgs(concatFilePath, episodePath(stagingDirPath, stagingName, profile.Format.Ext()), metadataPath, coverPath)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to transcode into %s: %w: %s", profile.Format, err, out)
+	}
+	if err := os.Remove(concatFilePath); err != nil {
+		return fmt.Errorf("failed to remove aac file: %w", err)
+	}
+	logger.Debug("complete transcoding", "format", profile.Format)
 	return nil
 }
+
+// writeFile creates the file at path and writes into it by write.
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,278 @@
+package radiko
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/library"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+func TestRunFetchers_ShutdownWithRetry(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	registerAuthResponders()
+
+	tempDir := t.TempDir()
+	store, err := OpenJobStore(JobStorePath(tempDir))
+	require.NoError(t, err)
+	cnf := config.Default()
+	cnf.OutDirPath = tempDir
+	cnf.Radiko.ShutdownGracePeriod = time.Minute
+	// the program guide is not served, so the job fails
+	job, err := store.Enqueue(Schedule{StationID: LFR, StartTime: time.Now().Add(-time.Hour).Truncate(time.Minute)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	toFetcher := make(chan Job)
+	// nobody receives retries, as the dispatcher has stopped
+	toRetry := make(chan Schedule)
+	done := RunFetchers(ctx, toFetcher, cnf, store, http.DefaultClient, toRetry, nil)
+	toFetcher <- job
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetchers did not stop within the grace period")
+	}
+	got, err := store.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobQueued, got.State)
+	assert.Equal(t, 1, got.Attempts)
+}
+
+func TestRunFetchers_Abort(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	registerAuthResponders()
+	// the program guide is served after the job is aborted
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/program/date/20231014/JP13.xml",
+		func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		})
+
+	tempDir := t.TempDir()
+	store, err := OpenJobStore(JobStorePath(tempDir))
+	require.NoError(t, err)
+	cnf := config.Default()
+	cnf.OutDirPath = tempDir
+	cnf.Radiko.ShutdownGracePeriod = 0
+	job, err := store.Enqueue(Schedule{StationID: LFR, StartTime: time.Date(2023, 10, 15, 1, 0, 0, 0, JST)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	toFetcher := make(chan Job)
+	done := RunFetchers(ctx, toFetcher, cnf, store, http.DefaultClient, make(chan Schedule), nil)
+	toFetcher <- job
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetchers did not abort")
+	}
+	// the aborted attempt is not counted, and the job is resumed on the next start
+	got, err := store.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobQueued, got.State)
+	assert.Equal(t, 0, got.Attempts)
+}
+
+func TestRunFetchers_StationNotAvailable(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	registerAuthResponders()
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/program/date/20231014/JP13.xml",
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+
+	tempDir := t.TempDir()
+	store, err := OpenJobStore(JobStorePath(tempDir))
+	require.NoError(t, err)
+	cnf := config.Default()
+	cnf.OutDirPath = tempDir
+	job, err := store.Enqueue(Schedule{StationID: "ABC", StartTime: time.Date(2023, 10, 15, 1, 0, 0, 0, JST)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	toFetcher := make(chan Job)
+	toRetry := make(chan Schedule, 1)
+	toDone := make(chan Job)
+	RunFetchers(ctx, toFetcher, cnf, store, http.DefaultClient, toRetry, toDone)
+	toFetcher <- job
+
+	// the job fails at once without retries, as the station is outside the area
+	select {
+	case got := <-toDone:
+		assert.Equal(t, JobFailed, got.State)
+		assert.True(t, got.Permanent)
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not finish")
+	}
+	assert.Empty(t, toRetry)
+	got, err := store.Get(job.ID)
+	require.NoError(t, err)
+	assert.True(t, got.Exhausted(cnf.Radiko.MaxAttempts))
+}
+
+func TestRecordedProg(t *testing.T) {
+	pg := &goradiko.Prog{Ft: "20231015010000", To: "20231015030000", Ftl: "2500", Tol: "2700", Dur: "7200", Title: "オードリーのオールナイトニッポン"}
+
+	prog := recordedProg(pg, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), time.Date(2023, 10, 15, 3, 0, 0, 0, JST))
+	assert.Equal(t, *pg, prog)
+
+	// the first hour
+	prog = recordedProg(pg, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), time.Date(2023, 10, 15, 2, 0, 0, 0, JST))
+	assert.Equal(t, "20231015020000", prog.To)
+	assert.Equal(t, "2600", prog.Tol)
+	assert.Equal(t, "3600", prog.Dur)
+	assert.Equal(t, pg.Title, prog.Title)
+
+	// spanning the next program from the middle
+	prog = recordedProg(pg, time.Date(2023, 10, 15, 2, 30, 0, 0, JST), time.Date(2023, 10, 15, 5, 0, 0, 0, JST))
+	assert.Equal(t, "20231015023000", prog.Ft)
+	assert.Equal(t, "2630", prog.Ftl)
+	assert.Equal(t, "2900", prog.Tol)
+	assert.Equal(t, "9000", prog.Dur)
+}
+
+func TestRunFetchers_MaxJobs(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	registerAuthResponders()
+
+	// the program guide is held until released, and then not found
+	var running, maxRunning atomic.Int32
+	release := make(chan struct{})
+	httpmock.RegisterResponder("GET",
+		`=~^https://radiko\.jp/v3/program/`,
+		func(req *http.Request) (*http.Response, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for m := maxRunning.Load(); n > m && !maxRunning.CompareAndSwap(m, n); m = maxRunning.Load() {
+			}
+			<-release
+			return httpmock.NewStringResponse(http.StatusNotFound, ""), nil
+		})
+
+	tempDir := t.TempDir()
+	store, err := OpenJobStore(JobStorePath(tempDir))
+	require.NoError(t, err)
+	cnf := config.Default()
+	cnf.OutDirPath = tempDir
+	cnf.Radiko.MaxJobs = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	toFetcher := make(chan Job)
+	toDone := make(chan Job)
+	done := RunFetchers(ctx, toFetcher, cnf, store, http.DefaultClient, nil, toDone)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	for i := 0; i < 3; i++ {
+		job, err := store.Enqueue(Schedule{StationID: LFR, StartTime: start.Add(time.Duration(i) * time.Minute)})
+		require.NoError(t, err)
+		toFetcher <- job
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, JobFailed, (<-toDone).State)
+	}
+	assert.Equal(t, int32(1), maxRunning.Load())
+	cancel()
+	<-done
+}
+
+func TestCommitEpisode(t *testing.T) {
+	const name = "オールナイトニッポン/20231015010000_LFR_オードリーのオールナイトニッポン"
+	stage := func(t *testing.T, exts ...string) string {
+		stagingDirPath := t.TempDir()
+		for _, ext := range exts {
+			require.NoError(t, os.WriteFile(episodePath(stagingDirPath, stagingName, ext), []byte(ext), 0644))
+		}
+		return stagingDirPath
+	}
+	// outFiles returns paths of files in outDirPath, relative to it
+	outFiles := func(t *testing.T, outDirPath string) []string {
+		var paths []string
+		err := filepath.WalkDir(outDirPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(outDirPath, path)
+			paths = append(paths, filepath.ToSlash(rel))
+			return err
+		})
+		require.NoError(t, err)
+		return paths
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		stagingDirPath := stage(t, ".aac", audio.ChaptersExt, ".xml")
+		outDirPath := t.TempDir()
+		require.NoError(t, commitEpisode(stagingDirPath, outDirPath, name, audio.AAC))
+		assert.ElementsMatch(t, []string{name + ".aac", name + audio.ChaptersExt, name + ".xml"}, outFiles(t, outDirPath))
+		assert.Empty(t, outFiles(t, stagingDirPath))
+	})
+
+	t.Run("without chapters", func(t *testing.T) {
+		stagingDirPath := stage(t, ".aac", ".xml")
+		outDirPath := t.TempDir()
+		require.NoError(t, commitEpisode(stagingDirPath, outDirPath, name, audio.AAC))
+		assert.ElementsMatch(t, []string{name + ".aac", name + ".xml"}, outFiles(t, outDirPath))
+	})
+
+	t.Run("failed to move audio", func(t *testing.T) {
+		stagingDirPath := stage(t, audio.ChaptersExt, ".xml")
+		outDirPath := t.TempDir()
+		assert.Error(t, commitEpisode(stagingDirPath, outDirPath, name, audio.AAC))
+		assert.Empty(t, outFiles(t, outDirPath))
+	})
+
+	t.Run("failed to move metadata", func(t *testing.T) {
+		stagingDirPath := stage(t, ".aac", audio.ChaptersExt, ".xml")
+		outDirPath := t.TempDir()
+		// a directory in place of the metadata makes its rename fail after the audio and the chapters are moved
+		require.NoError(t, os.MkdirAll(episodePath(outDirPath, name, ".xml"), 0755))
+		assert.Error(t, commitEpisode(stagingDirPath, outDirPath, name, audio.AAC))
+		assert.Empty(t, outFiles(t, outDirPath))
+		assert.FileExists(t, episodePath(stagingDirPath, stagingName, ".xml"))
+	})
+}
+
+func TestArchived(t *testing.T) {
+	// glob metacharacters in the output directory are taken as they are
+	outDirPath := filepath.Join(t.TempDir(), "[radiko]*")
+	store, err := OpenJobStore(JobStorePath(t.TempDir()))
+	require.NoError(t, err)
+	// episodes written by a nested name template without jobs
+	basePath := filepath.Join(outDirPath, "オードリー", "20231015010000_LFR_オードリーのオールナイトニッポン")
+	require.NoError(t, os.MkdirAll(filepath.Dir(basePath), 0755))
+	require.NoError(t, os.WriteFile(basePath+".aac", httpmock.File("testdata/chunk.aac").Bytes(), 0644))
+	require.NoError(t, os.WriteFile(basePath+".xml", []byte(`<Prog ft="20231015010000" to="20231015030000"></Prog>`), 0644))
+	items, err := library.List(outDirPath)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+
+	// start times out of JST are of the same broadcast
+	start := time.Date(2023, 10, 14, 16, 0, 0, 0, time.UTC)
+	assert.True(t, archived(store, outDirPath, items, Schedule{StationID: LFR, StartTime: start}))
+	assert.False(t, archived(store, outDirPath, items, Schedule{StationID: TBS, StartTime: start}))
+	assert.False(t, archived(store, outDirPath, items, Schedule{StationID: LFR, StartTime: start.Add(24 * time.Hour)}))
+}
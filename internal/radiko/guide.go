@@ -0,0 +1,247 @@
+package radiko
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+// ProgramGuide holds programs of each station, fetched from radiko program XML.
+type ProgramGuide map[StationID][]goradiko.Prog
+
+// ProgramMatcher matches programs by title, performers and description.
+// Nil fields match anything.
+type ProgramMatcher struct {
+	Title *regexp.Regexp
+	Pfm   *regexp.Regexp
+	Desc  *regexp.Regexp
+}
+
+func (m ProgramMatcher) Match(pg goradiko.Prog) bool {
+	if m.Title != nil && !m.Title.MatchString(pg.Title) {
+		return false
+	}
+	if m.Pfm != nil && !m.Pfm.MatchString(pg.Pfm) {
+		return false
+	}
+	if m.Desc != nil && !m.Desc.MatchString(pg.Desc) {
+		return false
+	}
+	return true
+}
+
+func fetchProgramGuide(ctx context.Context, radikoClient *goradiko.Client, stationIDs []StationID) (ProgramGuide, error) {
+	guide := make(ProgramGuide, len(stationIDs))
+	for _, stationID := range stationIDs {
+		if _, ok := guide[stationID]; ok {
+			continue
+		}
+		stations, err := radikoClient.GetWeeklyPrograms(ctx, string(stationID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get weekly programs of %s: %w", stationID, err)
+		}
+		progs := make([]goradiko.Prog, 0)
+		for _, s := range stations {
+			if s.ID == string(stationID) {
+				progs = append(progs, s.Progs.Progs...)
+			}
+		}
+		guide[stationID] = progs
+	}
+	return guide, nil
+}
+
+// guideDays is the number of days fetched for the program guide of the area.
+const guideDays = 7
+
+// fetchAreaProgramGuide fetches programs of all stations in the area of radikoClient broadcasted from the day of from to the day of to.
+func fetchAreaProgramGuide(ctx context.Context, radikoClient *goradiko.Client, from, to time.Time) (ProgramGuide, error) {
+	guide := make(ProgramGuide)
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		stations, err := radikoClient.GetStations(ctx, d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get programs of %s: %w", radikoClient.AreaID(), err)
+		}
+		for _, s := range stations {
+			guide.add(StationID(s.ID), s.Progs.Progs)
+		}
+	}
+	return guide, nil
+}
+
+// fetchRulesGuide fetches the program guide required by the rules.
+// Programs of the area are fetched from the day of from to guideDays after now.
+func fetchRulesGuide(ctx context.Context, radikoClient *goradiko.Client, rules []Rule, from, now time.Time) (ProgramGuide, error) {
+	guide, err := fetchProgramGuide(ctx, radikoClient, programStationIDs(rules))
+	if err != nil {
+		return nil, err
+	}
+	if hasAreaRule(rules) {
+		areaGuide, err := fetchAreaProgramGuide(ctx, radikoClient, from, now.AddDate(0, 0, guideDays-1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch program guide of area: %w", err)
+		}
+		guide.merge(areaGuide)
+	}
+	return guide, nil
+}
+
+// guideRefreshInterval is how long the program guide of rules is reused, as it changes at most daily.
+const guideRefreshInterval = 24 * time.Hour
+
+// rulesGuideCache keeps the program guide of rules fetched by fetchRulesGuide.
+type rulesGuideCache struct {
+	guide      ProgramGuide
+	stationIDs []StationID
+	area       bool
+	from       time.Time
+	fetchedAt  time.Time
+}
+
+// get returns the cached guide, or fetches it again when it is older than guideRefreshInterval,
+// or when the rules need programs of other stations or of earlier days.
+func (c *rulesGuideCache) get(ctx context.Context, radikoClient *goradiko.Client, rules []Rule, from, now time.Time) (ProgramGuide, error) {
+	stationIDs := slices.Clone(programStationIDs(rules))
+	slices.Sort(stationIDs)
+	area := hasAreaRule(rules)
+	if c.guide != nil && slices.Equal(stationIDs, c.stationIDs) && area == c.area &&
+		!(area && from.Before(c.from)) && now.Sub(c.fetchedAt) < guideRefreshInterval {
+		return c.guide, nil
+	}
+	guide, err := fetchRulesGuide(ctx, radikoClient, rules, from, now)
+	if err != nil {
+		return nil, err
+	}
+	*c = rulesGuideCache{guide: guide, stationIDs: stationIDs, area: area, from: from, fetchedAt: now}
+	return guide, nil
+}
+
+// add appends progs of the station, skipping programs already in the guide.
+func (g ProgramGuide) add(stationID StationID, progs []goradiko.Prog) {
+	for _, pg := range progs {
+		if !slices.ContainsFunc(g[stationID], func(p goradiko.Prog) bool { return p.Ft == pg.Ft }) {
+			g[stationID] = append(g[stationID], pg)
+		}
+	}
+}
+
+// merge adds all programs of other into the guide.
+func (g ProgramGuide) merge(other ProgramGuide) {
+	for stationID, progs := range other {
+		g.add(stationID, progs)
+	}
+}
+
+// stationIDs returns station IDs in the guide in sorted order.
+func (g ProgramGuide) stationIDs() []StationID {
+	stationIDs := make([]StationID, 0, len(g))
+	for stationID := range g {
+		stationIDs = append(stationIDs, stationID)
+	}
+	slices.Sort(stationIDs)
+	return stationIDs
+}
+
+// onAir returns the program of the station on air at t, or nil if it is not in the guide.
+func (g ProgramGuide) onAir(stationID StationID, t time.Time) *goradiko.Prog {
+	ft := t.In(JST).Format("20060102150405")
+	for i, pg := range g[stationID] {
+		// times in the same format are compared as strings
+		if pg.Ft <= ft && ft < pg.To {
+			return &g[stationID][i]
+		}
+	}
+	return nil
+}
+
+func parseProgTime(s string) (time.Time, error) {
+	return time.ParseInLocation("20060102150405", s, JST)
+}
+
+var errStationNotAvailable = errors.New("station not available in area")
+
+// programMeta is metadata of a program which goradiko.Prog lacks.
+type programMeta struct {
+	StationName string
+	ImageURL    string
+}
+
+// dailyStations is the program XML of a day, with metadata which goradiko lacks.
+type dailyStations struct {
+	Stations []struct {
+		ID    string `xml:"id,attr"`
+		Name  string `xml:"name"`
+		Progs []struct {
+			goradiko.Prog
+			Img string `xml:"img"`
+		} `xml:"progs>prog"`
+	} `xml:"stations>station"`
+}
+
+// fetchDailyPrograms fetches programs of the broadcast day of t in the area, or of the station if areaID is empty.
+func fetchDailyPrograms(ctx context.Context, radikoClient *goradiko.Client, t time.Time, areaID string, stationID StationID) (dailyStations, error) {
+	day := t.In(JST)
+	if day.Hour() < 5 {
+		// programs until 29:00 belong to the previous day
+		day = day.AddDate(0, 0, -1)
+	}
+	u := *radikoClient.URL
+	source := areaID
+	if areaID != "" {
+		u.Path = path.Join(u.Path, "v3/program/date", day.Format("20060102"), areaID+".xml")
+	} else {
+		source = string(stationID)
+		u.Path = path.Join(u.Path, "v3/program/station/date", day.Format("20060102"), source+".xml")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return dailyStations{}, err
+	}
+	resp, err := radikoClient.Do(req)
+	if err != nil {
+		return dailyStations{}, fmt.Errorf("failed to get programs of %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dailyStations{}, fmt.Errorf("failed to get programs of %s: %s", source, resp.Status)
+	}
+
+	var data dailyStations
+	if err := xml.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return dailyStations{}, fmt.Errorf("failed to decode programs of %s: %w", source, err)
+	}
+	return data, nil
+}
+
+// fetchProgram fetches the program on air at the start of the schedule from programs of the area,
+// or of the station if areaID is empty.
+// It returns errStationNotAvailable if the station doesn't broadcast in the area.
+func fetchProgram(ctx context.Context, radikoClient *goradiko.Client, areaID string, s Schedule) (*goradiko.Prog, programMeta, error) {
+	data, err := fetchDailyPrograms(ctx, radikoClient, s.StartTime, areaID, s.StationID)
+	if err != nil {
+		return nil, programMeta{}, err
+	}
+	ft := s.StartTime.In(JST).Format("20060102150405")
+	for _, st := range data.Stations {
+		if st.ID != string(s.StationID) {
+			continue
+		}
+		for _, pg := range st.Progs {
+			// times in the same format are compared as strings
+			if pg.Ft <= ft && ft < pg.To {
+				prog := pg.Prog
+				return &prog, programMeta{StationName: st.Name, ImageURL: pg.Img}, nil
+			}
+		}
+		return nil, programMeta{}, goradiko.ErrProgramNotFound
+	}
+	return nil, programMeta{}, fmt.Errorf("%w: %s is not in %s", errStationNotAvailable, s.StationID, areaID)
+}
@@ -0,0 +1,28 @@
+package radiko
+
+import (
+	"net/http"
+
+	"github.com/jarcoal/httpmock"
+)
+
+// registerAreaResponder responds to the area detection of goradiko.New with Tokyo.
+func registerAreaResponder() {
+	httpmock.RegisterResponder("GET",
+		"http://radiko.jp/area",
+		httpmock.NewStringResponder(http.StatusOK, `document.write('<span class="JP13">TOKYO JAPAN</span>');`))
+}
+
+func registerAuthResponders() {
+	registerAreaResponder()
+	auth1Header := make(http.Header)
+	auth1Header.Add("X-Radiko-AuthToken", "zsxMY0BGnwAuRpbelwK-JA")
+	auth1Header.Add("X-Radiko-KeyLength", "16")
+	auth1Header.Add("X-Radiko-KeyOffset", "10")
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v2/api/auth1",
+		httpmock.NewStringResponder(http.StatusOK, `please send a part of key`).HeaderAdd(auth1Header))
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v2/api/auth2",
+		httpmock.NewStringResponder(http.StatusOK, `JP13`))
+}
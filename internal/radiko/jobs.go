@@ -0,0 +1,214 @@
+package radiko
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type JobState string
+
+const (
+	JobQueued     JobState = "queued"
+	JobFetching   JobState = "fetching"
+	JobConverting JobState = "converting"
+	JobDone       JobState = "done"
+	JobFailed     JobState = "failed"
+)
+
+// Job is a record of fetching and converting one schedule.
+type Job struct {
+	ID       string   `json:"id"`
+	Schedule Schedule `json:"schedule"`
+	State    JobState `json:"state"`
+	Attempts int      `json:"attempts"`
+	Error    string   `json:"error,omitempty"`
+	// Permanent is set when the job failed by an error which retries cannot fix, like a station outside the area.
+	Permanent bool `json:"permanent,omitempty"`
+	// Name is the path of the episode relative to the output directory without extension, set when done.
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Finished reports whether the job will not be processed anymore.
+func (j Job) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed
+}
+
+// Exhausted reports whether the job failed permanently or with all of maxAttempts used, not to be attempted again.
+func (j Job) Exhausted(maxAttempts int) bool {
+	return j.State == JobFailed && (j.Permanent || j.Attempts >= maxAttempts)
+}
+
+const (
+	retryBaseInterval = time.Minute
+	retryMaxInterval  = 2 * time.Hour
+)
+
+// NextRetryTime returns when to retry the failed job, with exponential backoff and jitter.
+// It returns false when no more attempts remain or the time-shifted audio would be expired.
+func (j Job) NextRetryTime(now time.Time, maxAttempts int) (time.Time, bool) {
+	if j.Attempts >= maxAttempts {
+		return time.Time{}, false
+	}
+	backoff := retryMaxInterval
+	if j.Attempts < 16 {
+		backoff = min(retryBaseInterval<<(j.Attempts-1), retryMaxInterval)
+	}
+	backoff += time.Duration(rand.Int63n(int64(backoff) / 2))
+	retryTime := now.Add(backoff)
+	if retryTime.After(j.Schedule.StartTime.Add(timeshiftWindow)) {
+		return time.Time{}, false
+	}
+	return retryTime, true
+}
+
+const jobStoreFileName = ".radiko-archiver.db"
+
+var jobsBucket = []byte("jobs")
+
+var errJobNotFound = errors.New("job not found")
+
+// JobStorePath returns the path of the job store in outDirPath.
+// It is a dotfile, not to be published by the feed and the Dropbox syncer.
+func JobStorePath(outDirPath string) string {
+	return filepath.Join(outDirPath, jobStoreFileName)
+}
+
+// JobStore persists jobs into a bbolt file.
+// The file is opened for each transaction, so that other processes can query and record jobs while the scheduler runs.
+type JobStore struct {
+	path string
+}
+
+const jobStoreLockTimeout = 10 * time.Second
+
+func OpenJobStore(path string) (*JobStore, error) {
+	s := &JobStore{path: path}
+	if err := s.update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to open job store: %w", err)
+	}
+	return s, nil
+}
+
+func (s *JobStore) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: jobStoreLockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+func (s *JobStore) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: jobStoreLockTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// Enqueue records the schedule as a queued job. Attempts of an existing job are kept.
+// The job is returned even when it fails to be recorded.
+func (s *JobStore) Enqueue(sche Schedule) (Job, error) {
+	now := time.Now()
+	job := Job{
+		ID:        sche.ID(),
+		Schedule:  sche,
+		State:     JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		if v := b.Get([]byte(job.ID)); v != nil {
+			var old Job
+			if err := json.Unmarshal(v, &old); err != nil {
+				return err
+			}
+			job.Attempts = old.Attempts
+			job.CreatedAt = old.CreatedAt
+		}
+		return putJob(b, job)
+	})
+	if err != nil {
+		return job, fmt.Errorf("failed to enqueue job: %w", err)
+	}
+	return job, nil
+}
+
+// Save updates the job.
+func (s *JobStore) Save(job *Job) error {
+	job.UpdatedAt = time.Now()
+	if err := s.update(func(tx *bolt.Tx) error {
+		return putJob(tx.Bucket(jobsBucket), *job)
+	}); err != nil {
+		return fmt.Errorf("failed to save job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+func (s *JobStore) Get(id string) (Job, error) {
+	var job Job
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(jobsBucket).Get([]byte(id))
+		if v == nil {
+			return errJobNotFound
+		}
+		return json.Unmarshal(v, &job)
+	})
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to get job %s: %w", id, err)
+	}
+	return job, nil
+}
+
+// List returns jobs which satisfy filter, newest broadcast first. A nil filter returns all jobs.
+func (s *JobStore) List(filter func(Job) bool) ([]Job, error) {
+	jobs := make([]Job, 0)
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(_, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			if filter == nil || filter(job) {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	slices.SortFunc(jobs, func(a, b Job) int {
+		return b.Schedule.StartTime.Compare(a.Schedule.StartTime)
+	})
+	return jobs, nil
+}
+
+// Unfinished returns jobs interrupted before done or failed.
+func (s *JobStore) Unfinished() ([]Job, error) {
+	return s.List(func(j Job) bool {
+		return !j.Finished()
+	})
+}
+
+func putJob(b *bolt.Bucket, job Job) error {
+	v, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(job.ID), v)
+}
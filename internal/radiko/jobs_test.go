@@ -0,0 +1,105 @@
+package radiko
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobStore(t *testing.T) {
+	store, err := OpenJobStore(JobStorePath(t.TempDir()))
+	require.NoError(t, err)
+
+	sche1 := Schedule{
+		RuleName:  "星野源のオールナイトニッポン",
+		StationID: LFR,
+		StartTime: time.Date(2023, 10, 11, 1, 0, 0, 0, JST),
+		FetchTime: time.Date(2023, 10, 11, 7, 0, 0, 0, JST),
+	}
+	sche2 := Schedule{
+		RuleName:  "オードリーのオールナイトニッポン",
+		StationID: LFR,
+		StartTime: time.Date(2023, 10, 15, 1, 0, 0, 0, JST),
+		FetchTime: time.Date(2023, 10, 15, 7, 0, 0, 0, JST),
+	}
+
+	job1, err := store.Enqueue(sche1)
+	require.NoError(t, err)
+	assert.Equal(t, "LFR_20231011010000", job1.ID)
+	assert.Equal(t, JobQueued, job1.State)
+	job1.Attempts++
+	job1.State = JobDone
+	require.NoError(t, store.Save(&job1))
+
+	job2, err := store.Enqueue(sche2)
+	require.NoError(t, err)
+	job2.Attempts++
+	job2.State = JobFetching
+	require.NoError(t, store.Save(&job2))
+
+	jobs, err := store.List(nil)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, job2.ID, jobs[0].ID)
+	assert.Equal(t, job1.ID, jobs[1].ID)
+
+	unfinished, err := store.Unfinished()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	assert.Equal(t, JobFetching, unfinished[0].State)
+	assert.True(t, sche2.StartTime.Equal(unfinished[0].Schedule.StartTime))
+
+	job2, err = store.Enqueue(sche2)
+	require.NoError(t, err)
+	assert.Equal(t, JobQueued, job2.State)
+	assert.Equal(t, 1, job2.Attempts)
+
+	got, err := store.Get(job1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobDone, got.State)
+
+	_, err = store.Get("TBS_20231014010000")
+	assert.ErrorIs(t, err, errJobNotFound)
+}
+
+func TestJob_NextRetryTime(t *testing.T) {
+	now := time.Date(2023, 10, 15, 7, 0, 0, 0, JST)
+	job := Job{
+		Schedule: Schedule{
+			StationID: LFR,
+			StartTime: time.Date(2023, 10, 15, 1, 0, 0, 0, JST),
+		},
+	}
+
+	job.Attempts = 1
+	retryTime, ok := job.NextRetryTime(now, 5)
+	require.True(t, ok)
+	assert.GreaterOrEqual(t, retryTime.Sub(now), retryBaseInterval)
+	assert.Less(t, retryTime.Sub(now), retryBaseInterval*3/2)
+
+	job.Attempts = 3
+	retryTime, ok = job.NextRetryTime(now, 5)
+	require.True(t, ok)
+	assert.GreaterOrEqual(t, retryTime.Sub(now), 4*retryBaseInterval)
+	assert.Less(t, retryTime.Sub(now), 6*retryBaseInterval)
+
+	job.Attempts = 5
+	_, ok = job.NextRetryTime(now, 5)
+	assert.False(t, ok)
+
+	job.Attempts = 1
+	_, ok = job.NextRetryTime(job.Schedule.StartTime.Add(timeshiftWindow), 5)
+	assert.False(t, ok)
+}
+
+func TestJob_Exhausted(t *testing.T) {
+	job := Job{State: JobFailed, Attempts: 5}
+	assert.True(t, job.Exhausted(5))
+	assert.False(t, job.Exhausted(6))
+	job.State = JobQueued
+	assert.False(t, job.Exhausted(5))
+	job = Job{State: JobFailed, Attempts: 1, Permanent: true}
+	assert.True(t, job.Exhausted(5))
+}
@@ -0,0 +1,314 @@
+package radiko
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+// livePollInterval is the interval to poll the live playlist, shorter than the duration of its chunks.
+var livePollInterval = 2 * time.Second
+
+const (
+	// liveTailMargin is how long to keep polling after the end, until a chunk after the end is listed.
+	liveTailMargin = 30 * time.Second
+	// liveMaxFailures is the number of consecutive failures to poll the live playlist before playing the stream again.
+	liveMaxFailures = 10
+)
+
+var errBroadcastEnded = errors.New("broadcast already ended")
+
+// recordLive records the live stream of the program from the start of the schedule until its end.
+// It returns the program, its metadata and paths of the chunks in order.
+// Chunks recorded by an earlier attempt of the job are kept, and the rest of the broadcast is appended.
+func recordLive(ctx context.Context, logger *slog.Logger, s Schedule, auth *authorizer, dl *downloader, stagingDirPath, chunksDirPath string) (*goradiko.Prog, programMeta, []string, error) {
+	logger.Info("start recording live", "schedule", s)
+
+	areaID, token, err := auth.authorize(ctx)
+	if err != nil {
+		return nil, programMeta{}, nil, err
+	}
+	pg, meta, err := fetchProgram(ctx, auth.client, areaID, s)
+	if errors.Is(err, errStationNotAvailable) {
+		return nil, programMeta{}, nil, err
+	} else if err != nil {
+		return nil, programMeta{}, nil, fmt.Errorf("failed to fetch program: %w", err)
+	}
+	logger.Debug("get program", "program", pg)
+	endTime, err := s.endTime(pg)
+	if err != nil {
+		return nil, programMeta{}, nil, fmt.Errorf("invalid end time of program: %w", err)
+	}
+	if err := writeProgXML(stagingDirPath, pg, s.StartTime, endTime); err != nil {
+		return nil, programMeta{}, nil, err
+	}
+	if !time.Now().Before(endTime) {
+		// the broadcast ended while the job was stopped, and chunks recorded before are converted
+		chunkPaths := validChunks(logger, chunksDirPath)
+		if len(chunkPaths) == 0 {
+			return nil, programMeta{}, nil, fmt.Errorf("%w at %s", errBroadcastEnded, endTime.Format(time.DateTime))
+		}
+		logger.Warn("broadcast already ended, convert recorded chunks", "chunks", len(chunkPaths))
+		return pg, meta, chunkPaths, nil
+	}
+
+	chunkPaths, err := recordLiveUntil(ctx, logger, s, auth, dl, token, areaID == "", endTime, chunksDirPath)
+	if err != nil {
+		return nil, programMeta{}, nil, err
+	}
+	if len(chunkPaths) == 0 {
+		return nil, programMeta{}, nil, errors.New("no chunks recorded")
+	}
+
+	logger.Info("finish recording live")
+
+	return pg, meta, chunkPaths, nil
+}
+
+// recordLiveUntil records the live stream into chunksDirPath until endTime with the token, and returns paths of the chunks in order.
+// The stream is played again after the chunks recorded so far, when it fails by an outage or an expired token.
+// Once endTime has passed, the chunks recorded so far are returned even if the stream failed.
+func recordLiveUntil(ctx context.Context, logger *slog.Logger, s Schedule, auth *authorizer, dl *downloader, token string, areaFree bool, endTime time.Time, chunksDirPath string) ([]string, error) {
+	// chunks listed before are not recorded again on resumes
+	seen := make(map[string]bool)
+	for resumes := 0; ; resumes++ {
+		chunkPaths, err := recordLiveStream(ctx, logger, s, auth, dl, token, resumes > 0, areaFree, endTime, seen, chunksDirPath)
+		if err == nil {
+			return chunkPaths, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !time.Now().Before(endTime) {
+			if chunkPaths, _ = recordedChunks(chunksDirPath); len(chunkPaths) == 0 {
+				return nil, fmt.Errorf("failed to record live: %w", err)
+			}
+			logger.Warn("recording interrupted until the end, convert recorded chunks", "error", err, "chunks", len(chunkPaths))
+			return chunkPaths, nil
+		}
+		logger.Warn("recording interrupted, resume", "error", err, "resumes", resumes+1)
+		select {
+		case <-time.After(livePollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// recordLiveStream records the live stream into chunksDirPath until the end with the token, after chunks already recorded.
+// The token is authorized again if reauthorize, as it may have expired during a long broadcast.
+func recordLiveStream(ctx context.Context, logger *slog.Logger, s Schedule, auth *authorizer, dl *downloader, token string, reauthorize, areaFree bool, endTime time.Time, seen map[string]bool, chunksDirPath string) ([]string, error) {
+	if reauthorize {
+		areaID, t, err := auth.authorize(ctx)
+		if err != nil {
+			return nil, err
+		}
+		token = t
+		areaFree = areaID == ""
+	}
+	radikoClient := auth.client
+
+	playlistURL, err := livePlaylistURL(ctx, radikoClient, s.StationID, areaFree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live playlist: %w", err)
+	}
+	header := http.Header{"X-Radiko-Authtoken": {token}}
+	variants, err := dl.fetchChunklist(ctx, playlistURL, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live playlist: %w", err)
+	}
+	// the live playlist lists the chunklist of the stream
+	chunklistURL := variants[0].URL
+	logger.Debug("got live chunklist", "chunklistURL", chunklistURL)
+
+	return dl.recordStream(ctx, logger, chunklistURL, header, s.StartTime, endTime, seen, chunksDirPath)
+}
+
+// recordedChunks returns paths of chunks recorded in dirPath, in order.
+func recordedChunks(dirPath string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dirPath, "*.aac"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
+
+// validChunks returns paths of chunks recorded in dirPath in order, skipping broken ones such as written partly.
+func validChunks(logger *slog.Logger, dirPath string) []string {
+	paths, err := recordedChunks(dirPath)
+	if err != nil {
+		logger.Warn("failed to find recorded chunks", "error", err)
+		return nil
+	}
+	valid := make([]string, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			_, err = adtsDuration(data)
+		}
+		if err != nil {
+			logger.Warn("skip broken chunk", "path", path, "error", err)
+			continue
+		}
+		valid = append(valid, path)
+	}
+	return valid
+}
+
+// livePlaylistURL returns the URL of the live playlist of the station.
+func livePlaylistURL(ctx context.Context, radikoClient *goradiko.Client, stationID StationID, areaFree bool) (string, error) {
+	u := *radikoClient.URL
+	u.Path = path.Join(u.Path, "v3/station/stream/pc_html5", string(stationID)+".xml")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := radikoClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var data struct {
+		URLs []struct {
+			Timefree          string `xml:"timefree,attr"`
+			Areafree          string `xml:"areafree,attr"`
+			PlaylistCreateURL string `xml:"playlist_create_url"`
+		} `xml:"url"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", fmt.Errorf("failed to decode stream URLs: %w", err)
+	}
+	wantAreafree := "0"
+	if areaFree {
+		wantAreafree = "1"
+	}
+	for _, item := range data.URLs {
+		if item.Timefree != "0" || item.Areafree != wantAreafree {
+			continue
+		}
+		playlistURL, err := url.Parse(item.PlaylistCreateURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid playlist URL: %w", err)
+		}
+		lsid := make([]byte, 16)
+		if _, err := rand.Read(lsid); err != nil {
+			return "", err
+		}
+		q := playlistURL.Query()
+		q.Set("station_id", string(stationID))
+		q.Set("l", "15")
+		q.Set("lsid", hex.EncodeToString(lsid))
+		q.Set("type", "b")
+		playlistURL.RawQuery = q.Encode()
+		return playlistURL.String(), nil
+	}
+	return "", fmt.Errorf("no live stream of %s", stationID)
+}
+
+// recordStream polls the live chunklist and downloads new chunks into dirPath until the end.
+// Chunks are recorded only when they overlap [start, end). Chunks without their start time take it from the end of
+// the previous one, and are skipped if it is unknown, not to record the stream before the start.
+// URLs of chunks listed are added to seen, which is shared by resumes not to record the same chunks again.
+func (d *downloader) recordStream(ctx context.Context, logger *slog.Logger, chunklistURL string, header http.Header, start, end time.Time, seen map[string]bool, dirPath string) ([]string, error) {
+	// chunks of an earlier attempt come first, and recording continues after them
+	paths, err := recordedChunks(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	// chunks ending within the tolerance after the recorded part are taken as recorded
+	var tolerance time.Duration
+	if len(paths) > 0 {
+		tolerance = gapTolerance
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dur, err := adtsDuration(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk %s: %w", path, err)
+		}
+		start = start.Add(dur)
+	}
+
+	failures := 0
+	ticker := time.NewTicker(livePollInterval)
+	defer ticker.Stop()
+	for {
+		chunks, err := d.fetchChunklist(ctx, chunklistURL, header)
+		if err != nil {
+			failures++
+			if failures >= liveMaxFailures {
+				return nil, fmt.Errorf("failed to get chunklist: %w", err)
+			}
+			logger.Warn("failed to get chunklist", "error", err, "failures", failures)
+		} else {
+			failures = 0
+		}
+
+		ended := false
+		// chunks without their start time follow the previous one
+		var prevEnd time.Time
+		for _, c := range chunks {
+			if c.Time.IsZero() {
+				c.Time = prevEnd
+			}
+			prevEnd = time.Time{}
+			if !c.Time.IsZero() && c.Duration > 0 {
+				prevEnd = c.Time.Add(c.Duration)
+			}
+			if !c.Time.IsZero() && !c.Time.Before(end) {
+				ended = true
+				break
+			}
+			if seen[c.URL] {
+				continue
+			}
+			seen[c.URL] = true
+			if c.Time.IsZero() {
+				logger.Debug("skip chunk without start time", "url", c.URL)
+				continue
+			}
+			if c.Time.Add(c.Duration).Sub(start) <= tolerance {
+				continue
+			}
+			path := filepath.Join(dirPath, fmt.Sprintf("%05d.aac", len(paths)))
+			if err := d.downloadWithRetry(ctx, c, path); err != nil {
+				// a missing chunk is a gap in the recording, but the rest of the broadcast is still worth recording
+				logger.Warn("failed to download chunk", "error", err)
+				continue
+			}
+			paths = append(paths, path)
+		}
+		if ended || time.Now().After(end.Add(liveTailMargin)) {
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	logger.Debug("recorded chunks", "total", len(paths))
+	return paths, nil
+}
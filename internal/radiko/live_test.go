@@ -0,0 +1,268 @@
+package radiko
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+func TestLivePlaylistURL(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/station/stream/pc_html5/LFR.xml",
+		httpmock.NewStringResponder(http.StatusOK, `<?xml version="1.0" encoding="UTF-8"?>
+<urls>
+  <url timefree="1" areafree="0" max_delay="100">
+    <playlist_create_url>https://tf-f-rpaa-radiko.smartstream.ne.jp/tf/playlist.m3u8</playlist_create_url>
+  </url>
+  <url timefree="0" areafree="1" max_delay="100">
+    <playlist_create_url>https://si-f-radiko.smartstream.ne.jp/so/playlist.m3u8?areafree=1</playlist_create_url>
+  </url>
+  <url timefree="0" areafree="0" max_delay="100">
+    <playlist_create_url>https://si-f-radiko.smartstream.ne.jp/so/playlist.m3u8</playlist_create_url>
+  </url>
+</urls>`))
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+
+	playlistURL, err := livePlaylistURL(context.Background(), radikoClient, LFR, false)
+	require.NoError(t, err)
+	u, err := url.Parse(playlistURL)
+	require.NoError(t, err)
+	assert.Equal(t, "si-f-radiko.smartstream.ne.jp", u.Host)
+	assert.Equal(t, "LFR", u.Query().Get("station_id"))
+	assert.Len(t, u.Query().Get("lsid"), 32)
+	assert.Empty(t, u.Query().Get("areafree"))
+
+	playlistURL, err = livePlaylistURL(context.Background(), radikoClient, LFR, true)
+	require.NoError(t, err)
+	assert.Contains(t, playlistURL, "areafree=1")
+}
+
+func TestRecordStream(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	now := time.Now().Truncate(time.Second)
+	// chunks of 5 seconds from 10 seconds before now
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:5\n")
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&sb, "#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:5,\nhttps://media.radiko.jp/live/%d.aac\n",
+			now.Add(time.Duration(i-2)*5*time.Second).Format(time.RFC3339Nano), i)
+	}
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/live/chunklist.m3u8",
+		func(req *http.Request) (*http.Response, error) {
+			assert.Equal(t, "token", req.Header.Get("X-Radiko-AuthToken"))
+			return httpmock.NewStringResponse(http.StatusOK, sb.String()), nil
+		})
+	httpmock.RegisterResponder("GET",
+		`=~^https://media\.radiko\.jp/live/[0-9]\.aac$`,
+		httpmock.NewBytesResponder(http.StatusOK, httpmock.File("testdata/chunk.aac").Bytes()))
+
+	dirPath := t.TempDir()
+	dl := &downloader{client: http.DefaultClient, maxAttempts: 1}
+	header := http.Header{"X-Radiko-Authtoken": {"token"}}
+	paths, err := dl.recordStream(context.Background(), slog.Default(), "https://radiko.jp/live/chunklist.m3u8", header,
+		now.Add(-time.Second), now.Add(6*time.Second), make(map[string]bool), dirPath)
+	require.NoError(t, err)
+	// chunks from 5 seconds before now until 10 seconds after now overlap the range
+	require.Len(t, paths, 3)
+	info := httpmock.GetCallCountInfo()
+	assert.Equal(t, 0, info["GET https://media.radiko.jp/live/0.aac"])
+	assert.Equal(t, 1, info["GET https://media.radiko.jp/live/1.aac"])
+	assert.Equal(t, 1, info["GET https://media.radiko.jp/live/3.aac"])
+	assert.Equal(t, 0, info["GET https://media.radiko.jp/live/4.aac"])
+
+	t.Run("resume", func(t *testing.T) {
+		// the earlier attempt recorded 15 seconds from 5 seconds before now
+		paths, err := dl.recordStream(context.Background(), slog.Default(), "https://radiko.jp/live/chunklist.m3u8", header,
+			now.Add(-5*time.Second), now.Add(15*time.Second), make(map[string]bool), dirPath)
+		require.NoError(t, err)
+		require.Len(t, paths, 4)
+		assert.Equal(t, filepath.Join(dirPath, "00003.aac"), paths[3])
+		info := httpmock.GetCallCountInfo()
+		assert.Equal(t, 1, info["GET https://media.radiko.jp/live/3.aac"])
+		assert.Equal(t, 1, info["GET https://media.radiko.jp/live/4.aac"])
+	})
+}
+
+func TestRecordStream_WithoutTime(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	now := time.Now().Truncate(time.Second)
+	// the pre-roll and a chunk in the middle have no start time
+	chunklist := fmt.Sprintf(`#EXTM3U
+#EXT-X-TARGETDURATION:5
+#EXTINF:5,
+https://media.radiko.jp/live/0.aac
+#EXT-X-PROGRAM-DATE-TIME:%s
+#EXTINF:5,
+https://media.radiko.jp/live/1.aac
+#EXTINF:5,
+https://media.radiko.jp/live/2.aac
+#EXT-X-PROGRAM-DATE-TIME:%s
+#EXTINF:5,
+https://media.radiko.jp/live/3.aac
+#EXTINF:5,
+https://media.radiko.jp/live/4.aac
+`, now.Add(-5*time.Second).Format(time.RFC3339Nano), now.Add(5*time.Second).Format(time.RFC3339Nano))
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/live/chunklist.m3u8",
+		httpmock.NewStringResponder(http.StatusOK, chunklist))
+	httpmock.RegisterResponder("GET",
+		`=~^https://media\.radiko\.jp/live/[0-9]\.aac$`,
+		httpmock.NewBytesResponder(http.StatusOK, httpmock.File("testdata/chunk.aac").Bytes()))
+
+	dirPath := t.TempDir()
+	dl := &downloader{client: http.DefaultClient, maxAttempts: 1}
+	seen := make(map[string]bool)
+	paths, err := dl.recordStream(context.Background(), slog.Default(), "https://radiko.jp/live/chunklist.m3u8", nil,
+		now.Add(-5*time.Second), now.Add(10*time.Second), seen, dirPath)
+	require.NoError(t, err)
+	require.Len(t, paths, 3)
+	info := httpmock.GetCallCountInfo()
+	assert.Equal(t, 0, info["GET https://media.radiko.jp/live/0.aac"])
+	assert.Equal(t, 1, info["GET https://media.radiko.jp/live/2.aac"])
+	assert.Equal(t, 0, info["GET https://media.radiko.jp/live/4.aac"])
+
+	t.Run("resume", func(t *testing.T) {
+		// chunks seen before the stream is played again are not recorded again
+		httpmock.ZeroCallCounters()
+		paths, err := dl.recordStream(context.Background(), slog.Default(), "https://radiko.jp/live/chunklist.m3u8", nil,
+			now.Add(-5*time.Second), now.Add(10*time.Second), seen, dirPath)
+		require.NoError(t, err)
+		assert.Len(t, paths, 3)
+		info := httpmock.GetCallCountInfo()
+		assert.Equal(t, 0, info["GET https://media.radiko.jp/live/1.aac"])
+		assert.Equal(t, 0, info["GET https://media.radiko.jp/live/2.aac"])
+		assert.Equal(t, 0, info["GET https://media.radiko.jp/live/3.aac"])
+	})
+}
+
+func TestRecordLiveUntil(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	registerAuthResponders()
+	defer func(interval time.Duration) { livePollInterval = interval }(livePollInterval)
+	livePollInterval = 10 * time.Millisecond
+
+	// each authorization issues a new token, and only the latest one is accepted
+	tokens := 0
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v2/api/auth1",
+		func(req *http.Request) (*http.Response, error) {
+			tokens++
+			resp := httpmock.NewStringResponse(http.StatusOK, `please send a part of key`)
+			resp.Header.Set("X-Radiko-AuthToken", fmt.Sprintf("token%d", tokens))
+			resp.Header.Set("X-Radiko-KeyLength", "16")
+			resp.Header.Set("X-Radiko-KeyOffset", "10")
+			return resp, nil
+		})
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/station/stream/pc_html5/LFR.xml",
+		httpmock.NewStringResponder(http.StatusOK, `<?xml version="1.0" encoding="UTF-8"?>
+<urls>
+  <url timefree="0" areafree="0" max_delay="100">
+    <playlist_create_url>https://si-f-radiko.smartstream.ne.jp/so/playlist.m3u8</playlist_create_url>
+  </url>
+</urls>`))
+	httpmock.RegisterResponder("GET",
+		`=~^https://si-f-radiko\.smartstream\.ne\.jp/so/playlist\.m3u8`,
+		httpmock.NewStringResponder(http.StatusOK, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=52973\nhttps://radiko.jp/live/chunklist.m3u8\n"))
+
+	now := time.Now().Truncate(time.Second)
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:5\n")
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&sb, "#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:5,\nhttps://media.radiko.jp/live/%d.aac\n",
+			now.Add(time.Duration(i-2)*5*time.Second).Format(time.RFC3339Nano), i)
+	}
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/live/chunklist.m3u8",
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("X-Radiko-AuthToken") != fmt.Sprintf("token%d", tokens) || tokens < 2 {
+				return httpmock.NewStringResponse(http.StatusForbidden, ""), nil
+			}
+			return httpmock.NewStringResponse(http.StatusOK, sb.String()), nil
+		})
+	httpmock.RegisterResponder("GET",
+		`=~^https://media\.radiko\.jp/live/[0-9]\.aac$`,
+		httpmock.NewBytesResponder(http.StatusOK, httpmock.File("testdata/chunk.aac").Bytes()))
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+	auth := newAuthorizer(radikoClient, "", "")
+	_, token, err := auth.authorize(context.Background())
+	require.NoError(t, err)
+	dl := &downloader{client: http.DefaultClient, maxAttempts: 1}
+	s := Schedule{StationID: LFR, StartTime: now.Add(-time.Second)}
+
+	// the first token expires, and recording resumes with a new one
+	dirPath := t.TempDir()
+	paths, err := recordLiveUntil(context.Background(), slog.Default(), s, auth, dl, token, false, now.Add(6*time.Second), dirPath)
+	require.NoError(t, err)
+	assert.Len(t, paths, 3)
+	assert.Equal(t, 2, tokens)
+
+	t.Run("ended", func(t *testing.T) {
+		httpmock.RegisterResponder("GET",
+			"https://radiko.jp/live/chunklist.m3u8",
+			httpmock.NewStringResponder(http.StatusServiceUnavailable, ""))
+		// chunks recorded before the outage are returned after the end
+		paths, err := recordLiveUntil(context.Background(), slog.Default(), s, auth, dl, token, false, time.Now().Add(50*time.Millisecond), dirPath)
+		require.NoError(t, err)
+		assert.Len(t, paths, 3)
+
+		_, err = recordLiveUntil(context.Background(), slog.Default(), s, auth, dl, token, false, time.Now().Add(50*time.Millisecond), t.TempDir())
+		assert.Error(t, err)
+	})
+}
+
+func TestRecordLive_Ended(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	registerAuthResponders()
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/program/date/20231014/JP13.xml",
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+	auth := newAuthorizer(radikoClient, "", "")
+	dl := &downloader{client: http.DefaultClient, maxAttempts: 1}
+	s := Schedule{StationID: LFR, StartTime: time.Date(2023, 10, 15, 1, 0, 0, 0, JST), Live: true}
+
+	// chunks recorded before the job stopped are converted after the broadcast
+	stagingDirPath := t.TempDir()
+	chunksDirPath := filepath.Join(stagingDirPath, "chunks")
+	require.NoError(t, os.MkdirAll(chunksDirPath, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(chunksDirPath, "00000.aac"), httpmock.File("testdata/chunk.aac").Bytes(), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(chunksDirPath, "00001.aac"), []byte("broken"), 0644))
+	pg, _, paths, err := recordLive(context.Background(), slog.Default(), s, auth, dl, stagingDirPath, chunksDirPath)
+	require.NoError(t, err)
+	assert.Equal(t, "オードリーのオールナイトニッポン", pg.Title)
+	assert.Equal(t, []string{filepath.Join(chunksDirPath, "00000.aac")}, paths)
+
+	stagingDirPath = t.TempDir()
+	_, _, _, err = recordLive(context.Background(), slog.Default(), s, auth, dl, stagingDirPath, filepath.Join(stagingDirPath, "chunks"))
+	assert.ErrorIs(t, err, errBroadcastEnded)
+}
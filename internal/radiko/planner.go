@@ -4,20 +4,27 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"slices"
 	"time"
 
 	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/library"
 	"github.com/fsnotify/fsnotify"
 	"github.com/google/go-cmp/cmp"
+	goradiko "github.com/yyoshiki41/go-radiko"
 )
 
-func RunPlanner(ctx context.Context, toDispatcher chan<- []Schedule, cnf *config.Config) {
+// RunPlanner sends schedules of the rules to the dispatcher whenever they change.
+// Retries queued before the last shutdown are sent to toRetry, not to be replaced by the next schedules.
+// The returned channel is closed when the planner stops.
+func RunPlanner(ctx context.Context, toDispatcher chan<- []Schedule, toRetry chan<- Schedule, cnf *config.Config, store *JobStore, httpClient *http.Client) <-chan struct{} {
 	logger := slog.Default().With("job", "planner")
 	logger.Debug("start planner")
 
 	var rules []Rule
 	loadr := func() bool {
-		rs, err := loadRules(cnf.RulesPath)
+		rs, err := loadRules(cnf.RulesPath, cnf)
 		if err != nil {
 			logger.Error("failed to load rules", "error", err)
 			return false
@@ -27,22 +34,116 @@ func RunPlanner(ctx context.Context, toDispatcher chan<- []Schedule, cnf *config
 		return true
 	}
 
+	var (
+		radikoClient *goradiko.Client
+		guide        ProgramGuide
+		guideCache   rulesGuideCache
+	)
+	// loadGuide keeps the previous guide when fetching fails, not to drop schedules of program rules.
+	// Programs of the area are fetched from the day of from. The guide is fetched again daily or when the rules change it.
+	loadGuide := func(from time.Time) ProgramGuide {
+		if len(programStationIDs(rules)) == 0 && !hasAreaRule(rules) {
+			return nil
+		}
+		if radikoClient == nil {
+			c, err := newRadikoClient(httpClient)
+			if err != nil {
+				logger.Error("failed to create radiko client", "error", err)
+				return guide
+			}
+			if cnf.Radiko.AreaID != "" {
+				c.SetAreaID(cnf.Radiko.AreaID)
+			}
+			radikoClient = c
+		}
+		g, err := guideCache.get(ctx, radikoClient, rules, from, time.Now())
+		if err != nil {
+			logger.Error("failed to fetch program guide", "error", err)
+			return guide
+		}
+		guide = g
+		return guide
+	}
+
 	var sches []Schedule
 	updateSches := func() {
 		logger.Debug("update schedules")
-		newSches := newSchedules(rules)
+		newSches := newSchedules(rules, loadGuide(time.Now().Add(-maxOffsetTime(rules))))
 		if diff := cmp.Diff(sches, newSches); diff != "" {
 			logger.Info("schedules updated", "new", newSches)
 			sches = newSches
-			toDispatcher <- sches
+			select {
+			case toDispatcher <- sches:
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	// resumedSches returns schedules of jobs interrupted by the last shutdown, and retries queued before it.
+	resumedSches := func(now time.Time) ([]Schedule, []Schedule) {
+		jobs, err := store.Unfinished()
+		if err != nil {
+			logger.Error("failed to get unfinished jobs", "error", err)
+			return nil, nil
 		}
+		resumed, retries := resumedSchedules(jobs, now)
+		logger.Info("resume schedules", "schedules", resumed, "retries", retries)
+		return resumed, retries
 	}
 
+	// backfillSches returns schedules of broadcasts started from now-backfill until the offset time before now,
+	// which are still available as time-shifted audio, and neither archived yet nor given up after failures.
+	backfillSches := func(guide ProgramGuide, now time.Time, backfill time.Duration) []Schedule {
+		if backfill <= 0 {
+			return nil
+		}
+		items, err := library.List(cnf.OutDirPath)
+		if err != nil {
+			logger.Error("failed to list episodes", "error", err)
+		}
+		var missed []Schedule
+		for _, s := range pastSchedules(rules, guide, now.Add(-backfill), now) {
+			if archived(store, cnf.OutDirPath, items, s) {
+				continue
+			}
+			if job, err := store.Get(s.ID()); err == nil && job.Exhausted(cnf.Radiko.MaxAttempts) {
+				continue
+			}
+			missed = append(missed, s)
+		}
+		logger.Info("backfill schedules", "schedules", missed)
+		return missed
+	}
+
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		loadr()
-		updateSches()
+		// interrupted jobs and missed broadcasts are dispatched together with the first schedules
+		now := time.Now()
+		backfill := min(cnf.Radiko.Backfill, timeshiftWindow)
+		g := loadGuide(now.Add(-max(backfill, maxOffsetTime(rules))))
+		resumed, retries := resumedSches(now)
+		sches = appendUniqueSchedules(resumed, backfillSches(g, now, backfill)...)
+		sches = appendUniqueSchedules(sches, newSchedules(rules, g)...)
+		sches = slices.DeleteFunc(sches, func(s Schedule) bool {
+			return slices.ContainsFunc(retries, s.SameBroadcast)
+		})
+		logger.Info("schedules updated", "new", sches)
+		select {
+		case toDispatcher <- sches:
+		case <-ctx.Done():
+			return
+		}
+		for _, retry := range retries {
+			select {
+			case toRetry <- retry:
+			case <-ctx.Done():
+				return
+			}
+		}
 
-		ticker := time.NewTicker(plannerInterval)
+		ticker := time.NewTicker(cnf.Radiko.PlannerInterval)
 		watcher, err := fsnotify.NewWatcher()
 		if err != nil {
 			panic(fmt.Errorf("failed to create watcher: %w", err))
@@ -68,4 +169,21 @@ func RunPlanner(ctx context.Context, toDispatcher chan<- []Schedule, cnf *config
 			}
 		}
 	}()
+	return done
+}
+
+// resumedSchedules returns schedules of the unfinished jobs to be fetched at now, and queued retries.
+// Retries keep their retry time for the backoff, and are returned apart to be kept by the dispatcher as retries.
+func resumedSchedules(jobs []Job, now time.Time) ([]Schedule, []Schedule) {
+	var resumed, retries []Schedule
+	for _, job := range jobs {
+		s := job.Schedule
+		if job.State == JobQueued && s.FetchTime.After(now) {
+			retries = append(retries, s)
+			continue
+		}
+		s.FetchTime = now
+		resumed = append(resumed, s)
+	}
+	return resumed, retries
 }
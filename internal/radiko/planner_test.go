@@ -0,0 +1,28 @@
+package radiko
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumedSchedules(t *testing.T) {
+	now := time.Date(2023, 10, 15, 12, 0, 0, 0, JST)
+	start := time.Date(2023, 10, 15, 1, 0, 0, 0, JST)
+	retryTime := now.Add(30 * time.Minute)
+	jobs := []Job{
+		// interrupted while fetching
+		{State: JobFetching, Schedule: Schedule{StationID: LFR, StartTime: start, FetchTime: start.Add(6 * time.Hour)}},
+		// aborted by shutdown
+		{State: JobQueued, Schedule: Schedule{StationID: TBS, StartTime: start, FetchTime: start.Add(6 * time.Hour)}},
+		// waiting for the retry
+		{State: JobQueued, Schedule: Schedule{StationID: LFR, StartTime: start.Add(time.Hour), FetchTime: retryTime}},
+	}
+	sches, retries := resumedSchedules(jobs, now)
+	assert.Len(t, sches, 2)
+	assert.Equal(t, now, sches[0].FetchTime)
+	assert.Equal(t, now, sches[1].FetchTime)
+	assert.Len(t, retries, 1)
+	assert.Equal(t, retryTime, retries[0].FetchTime)
+}
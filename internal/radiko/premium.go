@@ -0,0 +1,111 @@
+package radiko
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+// authorizer authorizes the token of the radiko client, logging in to radiko premium if credentials are given.
+// The premium session is kept in the cookie jar of the client, reused across fetches and renewed on expiry.
+type authorizer struct {
+	client *goradiko.Client
+	// area is detected by the IP address, which radiko authorizes without premium.
+	area     string
+	mail     string
+	password string
+
+	mu sync.Mutex
+}
+
+func newAuthorizer(client *goradiko.Client, mail, password string) *authorizer {
+	return &authorizer{
+		client:   client,
+		area:     client.AreaID(),
+		mail:     mail,
+		password: password,
+	}
+}
+
+func (a *authorizer) premium() bool {
+	return a.mail != "" && a.password != ""
+}
+
+// authorize authorizes a token and returns the authorized area, or "" if all areas are authorized by radiko premium.
+// The client is shared by jobs which authorize again at any time, so callers must use the returned token,
+// not the one of the client.
+func (a *authorizer) authorize(ctx context.Context) (areaID, token string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	areaFree := false
+	if a.premium() {
+		if areaFree, err = a.login(ctx); err != nil {
+			return "", "", err
+		}
+	}
+	token, err = a.client.AuthorizeToken(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to authorize token: %w", err)
+	}
+	if areaFree {
+		return "", token, nil
+	}
+	return a.area, token, nil
+}
+
+// login logs in to radiko premium unless the session is alive, and reports whether the member is area-free.
+func (a *authorizer) login(ctx context.Context) (bool, error) {
+	status, err := a.loginCheck(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to check login: %w", err)
+	}
+	if status != nil {
+		return status.Areafree == "1", nil
+	}
+
+	res, err := a.client.Login(ctx, a.mail, a.password)
+	if err != nil {
+		return false, fmt.Errorf("failed to log in to radiko premium: %w", err)
+	}
+	switch res := res.(type) {
+	case goradiko.LoginOK:
+		return res.Areafree == "1", nil
+	case goradiko.LoginNG:
+		return false, fmt.Errorf("failed to log in to radiko premium: %s", res.Message)
+	}
+	return false, errors.New("failed to log in to radiko premium")
+}
+
+type loginStatus struct {
+	Areafree string `json:"areafree"`
+}
+
+// loginCheck returns the status of the session, or nil if it is not logged in or expired.
+func (a *authorizer) loginCheck(ctx context.Context) (*loginStatus, error) {
+	u := *a.client.URL
+	u.Path = path.Join(u.Path, "ap/member/webapi/member/login/check")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	var status loginStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode login status: %w", err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,76 @@
+package radiko
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+func TestAuthorizer_Authorize(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	registerAuthResponders()
+
+	loggedIn := false
+	httpmock.RegisterResponder("POST",
+		"https://radiko.jp/ap/member/webapi/member/login",
+		func(req *http.Request) (*http.Response, error) {
+			require.NoError(t, req.ParseForm())
+			if req.PostForm.Get("mail") == "test@example.com" && req.PostForm.Get("pass") == "password" {
+				loggedIn = true
+			}
+			return httpmock.NewStringResponse(http.StatusOK, `{}`), nil
+		})
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/ap/member/webapi/member/login/check",
+		func(req *http.Request) (*http.Response, error) {
+			if !loggedIn {
+				return httpmock.NewStringResponse(http.StatusBadRequest, `{"status":"400","message":"not logged in","cause":"login"}`), nil
+			}
+			return httpmock.NewStringResponse(http.StatusOK, `{"status":"200","user_key":"key","paid_member":"1","areafree":"1"}`), nil
+		})
+	const loginKey = "POST https://radiko.jp/ap/member/webapi/member/login"
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	t.Run("without premium", func(t *testing.T) {
+		areaID, _, err := newAuthorizer(radikoClient, "", "").authorize(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "JP13", areaID)
+		assert.Equal(t, 0, httpmock.GetCallCountInfo()[loginKey])
+	})
+
+	auth := newAuthorizer(radikoClient, "test@example.com", "password")
+	t.Run("login", func(t *testing.T) {
+		areaID, token, err := auth.authorize(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, areaID)
+		assert.Equal(t, "zsxMY0BGnwAuRpbelwK-JA", token)
+		assert.Equal(t, 1, httpmock.GetCallCountInfo()[loginKey])
+	})
+	t.Run("reuse session", func(t *testing.T) {
+		areaID, _, err := auth.authorize(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, areaID)
+		assert.Equal(t, 1, httpmock.GetCallCountInfo()[loginKey])
+	})
+	t.Run("login again on expiry", func(t *testing.T) {
+		loggedIn = false
+		areaID, _, err := auth.authorize(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, areaID)
+		assert.Equal(t, 2, httpmock.GetCallCountInfo()[loginKey])
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		loggedIn = false
+		_, _, err := newAuthorizer(radikoClient, "test@example.com", "wrong").authorize(ctx)
+		assert.EqualError(t, err, "failed to log in to radiko premium: not logged in")
+	})
+}
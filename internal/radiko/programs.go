@@ -0,0 +1,158 @@
+package radiko
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/abekoh/radiko-archiver/internal/config"
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+// Program is a program of the station in the program guide.
+type Program struct {
+	StationID StationID `json:"station_id"`
+	goradiko.Prog
+	// TimeshiftURL is the time-shifted URL of radiko, which the fetch command accepts.
+	TimeshiftURL string `json:"timeshift_url"`
+	// Rule is a rules.toml snippet to archive the program every week.
+	Rule string `json:"rule"`
+}
+
+// ProgramQuery filters programs searched by SearchPrograms.
+type ProgramQuery struct {
+	StationIDs []StationID
+	// Date is the broadcast day to search. The weekly program guide is searched if zero.
+	Date    time.Time
+	Matcher ProgramMatcher
+	// From and To are the time range in broadcast days like "25:00", which programs overlap.
+	// Hours before 5 are of the next day, as radio listings are. Empty means unbounded.
+	From string
+	To   string
+}
+
+// broadcastDayStartHour is the hour when broadcast days of radiko begin.
+const broadcastDayStartHour = maxBroadcastHour - 24
+
+// SearchPrograms returns programs of the stations which match the query, in order of start time.
+func SearchPrograms(ctx context.Context, cnf *config.Config, q ProgramQuery) ([]Program, error) {
+	from, err := parseRangeClock(q.From, broadcastDayStartHour*time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := parseRangeClock(q.To, maxBroadcastHour*time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to: %w", err)
+	}
+
+	radikoClient, err := newAreaRadikoClient(cnf)
+	if err != nil {
+		return nil, err
+	}
+	var guide ProgramGuide
+	if q.Date.IsZero() {
+		guide, err = fetchProgramGuide(ctx, radikoClient, q.StationIDs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		guide = make(ProgramGuide)
+		day := time.Date(q.Date.Year(), q.Date.Month(), q.Date.Day(), broadcastDayStartHour, 0, 0, 0, JST)
+		for _, stationID := range q.StationIDs {
+			data, err := fetchDailyPrograms(ctx, radikoClient, day, "", stationID)
+			if err != nil {
+				return nil, err
+			}
+			for _, st := range data.Stations {
+				if st.ID != string(stationID) {
+					continue
+				}
+				for _, pg := range st.Progs {
+					guide.add(stationID, []goradiko.Prog{pg.Prog})
+				}
+			}
+		}
+	}
+
+	programs := make([]Program, 0)
+	for _, stationID := range guide.stationIDs() {
+		for _, pg := range guide[stationID] {
+			if !q.Matcher.Match(pg) {
+				continue
+			}
+			startTime, err := parseProgTime(pg.Ft)
+			if err != nil {
+				return nil, fmt.Errorf("invalid start time of program: %w", err)
+			}
+			endTime, err := parseProgTime(pg.To)
+			if err != nil {
+				return nil, fmt.Errorf("invalid end time of program: %w", err)
+			}
+			day := broadcastDay(startTime)
+			if !endTime.After(day.Add(from)) || !startTime.Before(day.Add(to)) {
+				continue
+			}
+			programs = append(programs, newProgram(stationID, pg, startTime))
+		}
+	}
+	slices.SortStableFunc(programs, func(a, b Program) int {
+		return strings.Compare(a.Ft, b.Ft)
+	})
+	return programs, nil
+}
+
+// parseRangeClock returns the time since the beginning of the broadcast day like "25:00", or def if s is empty.
+func parseRangeClock(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	hour, minute, err := parseClock(s)
+	if err != nil {
+		return 0, err
+	}
+	if hour < broadcastDayStartHour {
+		hour += 24
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+func newProgram(stationID StationID, pg goradiko.Prog, startTime time.Time) Program {
+	return Program{
+		StationID:    stationID,
+		Prog:         pg,
+		TimeshiftURL: fmt.Sprintf("https://radiko.jp/#!/ts/%s/%s", stationID, pg.Ft),
+		Rule:         ruleSnippet(stationID, pg.Title, startTime),
+	}
+}
+
+// snippetRule is a weekday rule in rules.toml.
+type snippetRule struct {
+	Name      string `toml:"name"`
+	StationID string `toml:"station_id"`
+	Weekday   string `toml:"weekday"`
+	Start     string `toml:"start"`
+}
+
+// ruleSnippet returns a rules.toml entry of the weekday and the start time of the program, in the notation of radio listings.
+func ruleSnippet(stationID StationID, title string, startTime time.Time) string {
+	day := broadcastDay(startTime)
+	start := startTime.In(JST).Sub(day)
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	_ = enc.Encode(struct {
+		Rules []snippetRule `toml:"rules"`
+	}{
+		Rules: []snippetRule{{
+			Name:      title,
+			StationID: string(stationID),
+			Weekday:   day.Format("Mon"),
+			Start:     fmt.Sprintf("%02d:%02d", int(start.Hours()), int(start.Minutes())%60),
+		}},
+	})
+	return buf.String()
+}
@@ -0,0 +1,76 @@
+package radiko
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchPrograms(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/program/station/weekly/LFR.xml",
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/program/station/date/20231014/LFR.xml",
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+	ctx := context.Background()
+	cnf := config.Default()
+
+	t.Run("title", func(t *testing.T) {
+		programs, err := SearchPrograms(ctx, cnf, ProgramQuery{
+			StationIDs: []StationID{LFR},
+			Matcher:    ProgramMatcher{Title: regexp.MustCompile("オードリーのオールナイトニッポン")},
+		})
+		require.NoError(t, err)
+		require.Len(t, programs, 1)
+		p := programs[0]
+		assert.Equal(t, LFR, p.StationID)
+		assert.Equal(t, "20231015010000", p.Ft)
+		assert.Equal(t, "https://radiko.jp/#!/ts/LFR/20231015010000", p.TimeshiftURL)
+		assert.Equal(t, `[[rules]]
+name = "オードリーのオールナイトニッポン"
+station_id = "LFR"
+weekday = "Sat"
+start = "25:00"
+`, p.Rule)
+
+		// the snippet is a valid rule of the same broadcast
+		rules, err := loadRules(writeRules(t, p.Rule), cnf)
+		require.NoError(t, err)
+		s, ok := rules[0].nextSchedule(time.Date(2023, 10, 14, 12, 0, 0, 0, JST))
+		require.True(t, ok)
+		assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), s.StartTime)
+	})
+
+	t.Run("time range of date", func(t *testing.T) {
+		programs, err := SearchPrograms(ctx, cnf, ProgramQuery{
+			StationIDs: []StationID{LFR},
+			Date:       time.Date(2023, 10, 14, 0, 0, 0, 0, JST),
+			From:       "01:30",
+			To:         "03:30",
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, programs)
+		for _, p := range programs {
+			assert.Less(t, p.Ft, "20231015033000")
+			assert.Greater(t, p.To, "20231015013000")
+		}
+		assert.Equal(t, "20231015010000", programs[0].Ft)
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		_, err := SearchPrograms(ctx, cnf, ProgramQuery{StationIDs: []StationID{LFR}, From: "30:00"})
+		assert.Error(t, err)
+	})
+}
@@ -2,64 +2,303 @@ package radiko
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/abekoh/radiko-archiver/internal/httpclient"
+	goradiko "github.com/yyoshiki41/go-radiko"
 )
 
-func RunScheduler(ctx context.Context, cnf *config.Config) {
+// RunScheduler runs the planner, the dispatcher and fetchers.
+// The returned channel is closed when all of them stop after ctx is done.
+func RunScheduler(ctx context.Context, cnf *config.Config, store *JobStore) <-chan struct{} {
+	if err := removeStaging(cnf.OutDirPath, store); err != nil {
+		slog.Default().Error("failed to remove staging directories", "error", err)
+	}
+
+	httpClient, err := httpclient.New(cnf.HTTP)
+	if err != nil {
+		panic(fmt.Errorf("invalid http config: %w", err))
+	}
+
 	toDispatcher := make(chan []Schedule)
-	toFetcher := make(chan Schedule)
+	toRetry := make(chan Schedule)
+	toFetcher := make(chan Job)
+
+	plannerDone := RunPlanner(ctx, toDispatcher, toRetry, cnf, store, httpClient)
+	dispatcherDone := RunDispatcher(ctx, toDispatcher, toRetry, toFetcher, store)
+	fetchersDone := RunFetchers(ctx, toFetcher, cnf, store, httpClient, toRetry, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-plannerDone
+		<-dispatcherDone
+		<-fetchersDone
+	}()
+	return done
+}
+
+// Fetch fetches and converts the schedule once, recording it as a job.
+// It returns the finished job, with an error if the job failed.
+func Fetch(ctx context.Context, cnf *config.Config, sche Schedule) (Job, error) {
+	results, err := FetchAll(ctx, cnf, []Schedule{sche}, 1)
+	if err != nil {
+		return Job{}, err
+	}
+	if results[0].Error != "" {
+		return results[0].Job, fmt.Errorf("failed to fetch %s: %s", sche, results[0].Error)
+	}
+	return results[0].Job, nil
+}
 
-	RunPlanner(ctx, toDispatcher, cnf)
-	RunDispatcher(ctx, toDispatcher, toFetcher)
-	RunFetchers(ctx, toFetcher, cnf, nil)
+// FetchResult is the result of fetching a schedule by FetchAll.
+type FetchResult struct {
+	Job   Job    `json:"job"`
+	Error string `json:"error,omitempty"`
 }
 
-func RunFromURL(ctx context.Context, tsURL string, cnf *config.Config) {
-	logger := slog.Default().With("job", "run-from-url")
-	toFetcher := make(chan Schedule)
-	toDone := make(chan bool)
+// FetchAll fetches and converts the schedules once, concurrency jobs at a time, recording them as jobs.
+// Results are in the order of the schedules. Schedules of the same broadcast are fetched only once.
+// When ctx is done, running jobs are given the shutdown grace period, and the rest are not started.
+func FetchAll(ctx context.Context, cnf *config.Config, sches []Schedule, concurrency int) ([]FetchResult, error) {
+	logger := slog.Default().With("job", "fetch")
+	concurrency = max(concurrency, 1)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	store, err := OpenJobStore(JobStorePath(cnf.OutDirPath))
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := httpclient.New(cnf.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http config: %w", err)
+	}
+
+	results := make([]FetchResult, len(sches))
+	// indexes of results by job ID
+	indexes := make(map[string][]int)
+	var targets []Schedule
+	for i, sche := range sches {
+		id := sche.ID()
+		if _, ok := indexes[id]; !ok {
+			targets = append(targets, sche)
+		}
+		indexes[id] = append(indexes[id], i)
+	}
+	record := func(job Job, errMsg string) {
+		for _, i := range indexes[job.ID] {
+			results[i] = FetchResult{Job: job, Error: errMsg}
+		}
+	}
+
+	fetchCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	toFetcher := make(chan Job)
+	toDone := make(chan Job)
+	fetchersDone := RunFetchers(fetchCtx, toFetcher, cnf, store, httpClient, nil, toDone)
+
+	// jobs are enqueued just before they are sent, not to leave jobs never started queued in the store,
+	// which the scheduler would resume
+	var (
+		pending  Job
+		enqueued bool
+	)
+	next, running := 0, 0
+	canceled := ctx.Done()
+	for next < len(targets) || running > 0 {
+		var send chan<- Job
+		if next < len(targets) && running < concurrency && ctx.Err() == nil {
+			if !enqueued {
+				job, err := store.Enqueue(targets[next])
+				if err != nil {
+					logger.Error("failed to enqueue job", "error", err)
+				}
+				pending, enqueued = job, true
+			}
+			send = toFetcher
+		}
+		select {
+		case send <- pending:
+			logger.Info("start", "schedule", pending.Schedule)
+			enqueued = false
+			next++
+			running++
+		case job := <-toDone:
+			running--
+			switch job.State {
+			case JobDone:
+				logger.Info("done", "name", job.Name)
+				record(job, "")
+			case JobFailed:
+				record(job, job.Error)
+			default:
+				record(job, "aborted")
+			}
+		case <-canceled:
+			// running jobs are waited for, and the rest are not started
+			canceled = nil
+			if enqueued {
+				// the job is finished, as it is not started
+				pending.State = JobFailed
+				pending.Error = ctx.Err().Error()
+				if err := store.Save(&pending); err != nil {
+					logger.Error("failed to save job", "error", err)
+				}
+				enqueued = false
+			}
+			for _, s := range targets[next:] {
+				record(Job{ID: s.ID(), Schedule: s}, ctx.Err().Error())
+			}
+			next = len(targets)
+		}
+	}
+	cancel()
+	<-fetchersDone
+	return results, nil
+}
+
+// UpcomingSchedules returns schedules of the rules to be fetched next, as the planner plans them.
+// The program guide is fetched when program rules exist.
+func UpcomingSchedules(ctx context.Context, cnf *config.Config) ([]Schedule, error) {
+	rules, err := loadRules(cnf.RulesPath, cnf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rules: %w", err)
+	}
+	var guide ProgramGuide
+	if len(programStationIDs(rules)) > 0 || hasAreaRule(rules) {
+		radikoClient, err := newAreaRadikoClient(cnf)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		guide, err = fetchRulesGuide(ctx, radikoClient, rules, now.Add(-maxOffsetTime(rules)), now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newSchedules(rules, guide), nil
+}
 
-	sche, err := parseURL(tsURL)
+// newAreaRadikoClient returns a radiko client for the area of the config.
+func newAreaRadikoClient(cnf *config.Config) (*goradiko.Client, error) {
+	httpClient, err := httpclient.New(cnf.HTTP)
 	if err != nil {
-		logger.Error("failed to parse URL", "error", err)
-		return
+		return nil, fmt.Errorf("invalid http config: %w", err)
 	}
-	logger.Info("start", "schedule", sche)
-	RunFetchers(ctx, toFetcher, cnf, toDone)
-	toFetcher <- sche
-	if <-toDone {
-		logger.Info("done")
-	} else {
-		logger.Error("failed")
+	radikoClient, err := newRadikoClient(httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create radiko client: %w", err)
 	}
+	if cnf.Radiko.AreaID != "" {
+		radikoClient.SetAreaID(cnf.Radiko.AreaID)
+	}
+	return radikoClient, nil
 }
 
-func parseURL(tsURL string) (Schedule, error) {
-	re := regexp.MustCompile(`\/ts\/([A-Z]+)\/([0-9]+)$`)
-	matches := re.FindStringSubmatch(tsURL)
+var newRadikoClientMu sync.Mutex
+
+// newRadikoClient returns a radiko client on a copy of httpClient, as goradiko sets its own cookie jar on the client.
+func newRadikoClient(httpClient *http.Client) (*goradiko.Client, error) {
+	newRadikoClientMu.Lock()
+	defer newRadikoClientMu.Unlock()
+	c := *httpClient
+	goradiko.SetHTTPClient(&c)
+	return goradiko.New("")
+}
+
+// tsURLRegexp matches time-shifted URLs like "https://radiko.jp/#!/ts/LFR/20231015010000", which may be followed by queries.
+var tsURLRegexp = regexp.MustCompile(`/ts/([A-Z0-9-]+)/([0-9]{12,14})(?:[/?&#]|$)`)
+
+// ParseURL returns the schedule of the radiko time-shifted URL like "https://radiko.jp/#!/ts/LFR/20231015010000",
+// or of the share URL like "https://radiko.jp/share/?sid=LFR&t=20231015010000".
+func ParseURL(rawURL string) (Schedule, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return Schedule{}, fmt.Errorf("invalid URL: %w", err)
+	}
+	if q := u.Query(); q.Get("sid") != "" && q.Get("t") != "" {
+		return ParseStationTime(q.Get("sid"), q.Get("t"), "")
+	}
+	matches := tsURLRegexp.FindStringSubmatch(rawURL)
 	if len(matches) < 3 {
-		return Schedule{}, fmt.Errorf("invalid URL format")
+		return Schedule{}, fmt.Errorf("invalid URL format: %s", rawURL)
+	}
+	return ParseStationTime(matches[1], matches[2], "")
+}
+
+// ParseTarget returns the schedule of a URL, or of a station ID, a start time and optionally an end time.
+func ParseTarget(args []string) (Schedule, error) {
+	switch {
+	case len(args) == 1 && strings.Contains(args[0], "://"):
+		return ParseURL(args[0])
+	case len(args) == 2:
+		return ParseStationTime(args[0], args[1], "")
+	case len(args) == 3:
+		return ParseStationTime(args[0], args[1], args[2])
+	default:
+		return Schedule{}, fmt.Errorf("invalid target: %s", strings.Join(args, " "))
 	}
+}
+
+// ParseTargetLine returns the schedule of a line of a list, which is a URL, or a station ID with start and end times.
+// Fields are separated by tabs or commas, to give times with spaces like "LFR,2023-10-15 01:00,2023-10-15 02:00",
+// or by spaces if the line has neither of them.
+func ParseTargetLine(line string) (Schedule, error) {
+	if !strings.ContainsAny(line, "\t,") {
+		return ParseTarget(strings.Fields(line))
+	}
+	fields := strings.FieldsFunc(line, func(r rune) bool { return r == '\t' || r == ',' })
+	for i, f := range fields {
+		fields[i] = strings.TrimSpace(f)
+	}
+	return ParseTarget(fields)
+}
 
-	stationID := matches[1]
-	startTimeStr := matches[2]
+// timeLayouts are layouts of times given by users, in JST.
+var timeLayouts = []string{"20060102150405", "200601021504", "2006-01-02 15:04", "2006-01-02T15:04", time.DateTime}
 
-	startTime, err := time.ParseInLocation("20060102150405", startTimeStr, JST)
+func parseUserTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, JST); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+// ParseStationTime returns the schedule of the station from start until end, like "20231015010000" or "2023-10-15 01:00".
+// The schedule lasts until the end of the program if end is empty.
+func ParseStationTime(stationID, start, end string) (Schedule, error) {
+	if stationID == "" {
+		return Schedule{}, errors.New("station ID is required")
+	}
+	startTime, err := parseUserTime(start)
 	if err != nil {
-		return Schedule{}, err
+		return Schedule{}, fmt.Errorf("invalid start time: %w", err)
 	}
-	return Schedule{
+	s := Schedule{
 		RuleName:  "FromURL",
 		StationID: StationID(stationID),
 		StartTime: startTime,
 		FetchTime: time.Now(),
-	}, nil
+	}
+	if end != "" {
+		endTime, err := parseUserTime(end)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("invalid end time: %w", err)
+		}
+		if !endTime.After(startTime) {
+			return Schedule{}, fmt.Errorf("end time %s is not after start time", end)
+		}
+		s.Duration = endTime.Sub(startTime)
+	}
+	return s, nil
 }
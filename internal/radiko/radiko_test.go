@@ -1,55 +1,64 @@
 package radiko
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/abekoh/radiko-archiver/internal/config"
 	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	goradiko "github.com/yyoshiki41/go-radiko"
 )
 
-func TestRunFromURL(t *testing.T) {
+func TestFetch(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder("GET",
-		"http://radiko.jp/area",
-		httpmock.NewStringResponder(http.StatusOK, `document.write('<span class="JP13">TOKYO JAPAN</span>');`))
-	auth1Header := make(http.Header)
-	auth1Header.Add("X-Radiko-AuthToken", "zsxMY0BGnwAuRpbelwK-JA")
-	auth1Header.Add("X-Radiko-KeyLength", "16")
-	auth1Header.Add("X-Radiko-KeyOffset", "10")
-	httpmock.RegisterResponder("GET",
-		"https://radiko.jp/v2/api/auth1",
-		httpmock.NewStringResponder(http.StatusOK, `please send a part of key`).HeaderAdd(auth1Header))
-	httpmock.RegisterResponder("GET",
-		"https://radiko.jp/v2/api/auth2",
-		httpmock.NewStringResponder(http.StatusOK, `JP13`))
+	registerAuthResponders()
 	httpmock.RegisterResponder("GET",
 		"https://radiko.jp/v3/program/date/20231014/JP13.xml",
 		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
 	httpmock.RegisterResponder("POST",
 		"https://radiko.jp/v2/api/ts/playlist.m3u8?ft=20231015010000&l=15&station_id=LFR&to=20231015030000",
 		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/uri.m3u8")))
+	// the chunklist covers the whole program, as truncated recordings are rejected
+	var chunklist strings.Builder
+	chunklist.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:5\n")
+	for ft := time.Date(2023, 10, 15, 1, 0, 0, 0, JST); ft.Before(time.Date(2023, 10, 15, 3, 0, 0, 0, JST)); ft = ft.Add(5 * time.Second) {
+		fmt.Fprintf(&chunklist, "#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:5,\nhttps://media.radiko.jp/sound/b/LFR/20231015/20231015_%s_5kTKg.aac\n",
+			ft.Format(time.RFC3339), ft.Format("150405"))
+	}
+	chunklist.WriteString("#EXT-X-ENDLIST\n")
 	httpmock.RegisterResponder("GET",
 		"https://radiko.jp/v2/api/ts/chunklist/v1cA1fcZ.m3u8",
-		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/v1cA1fcZ.m3u8")))
+		httpmock.NewStringResponder(http.StatusOK, chunklist.String()))
 	httpmock.RegisterResponder("GET",
 		`=~^https:\/\/media\.radiko\.jp\/sound\/b\/LFR\/20231015\/20231015_[0-9]{6}_[a-zA-Z0-9]{5}\.aac$`,
-		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/sample3.aac")))
+		httpmock.NewBytesResponder(http.StatusOK, httpmock.File("testdata/chunk.aac").Bytes()).HeaderSet(http.Header{"Content-Type": {"audio/aac"}}))
+	cover := []byte("\xff\xd8\xff\xe0cover")
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/res/program/DEFAULT_IMAGE/LFR/40zg3cgaf8.jpg",
+		httpmock.NewBytesResponder(http.StatusOK, cover))
 
 	tempDir := t.TempDir()
 	ctx := context.Background()
 	tsURL := "https://radiko.jp/#!/ts/LFR/20231015010000"
-	cnf := &config.Config{
-		OutDirPath: tempDir,
-	}
-	RunFromURL(ctx, tsURL, cnf)
+	cnf := config.Default()
+	cnf.OutDirPath = tempDir
+	sche, err := ParseURL(tsURL)
+	require.NoError(t, err)
+	job, err := Fetch(ctx, cnf, sche)
+	require.NoError(t, err)
+	assert.Equal(t, JobDone, job.State)
 
 	xmlRes, err := os.ReadFile(filepath.Join(tempDir, "20231015010000_LFR_オードリーのオールナイトニッポン.xml"))
 	require.NoError(t, err)
@@ -65,4 +74,132 @@ func TestRunFromURL(t *testing.T) {
 	aacRes, err := os.ReadFile(filepath.Join(tempDir, "20231015010000_LFR_オードリーのオールナイトニッポン.aac"))
 	require.NoError(t, err)
 	assert.Greater(t, len(aacRes), 0)
+	assert.True(t, bytes.HasPrefix(aacRes, []byte("ID3")))
+	tagLength, err := id3TagLength(aacRes)
+	require.NoError(t, err)
+	tag := aacRes[:tagLength]
+	assert.Contains(t, string(tag), "オードリーのオールナイトニッポン")
+	assert.Contains(t, string(tag), "ニッポン放送")
+	assert.Contains(t, string(tag), "2023-10-15T01:00")
+	assert.True(t, bytes.Contains(tag, cover))
+	_, err = writeADTSFrames(io.Discard, aacRes)
+	assert.NoError(t, err)
+	assert.Contains(t, string(tag), "オープニングトーク")
+
+	chaptersRes, err := os.ReadFile(filepath.Join(tempDir, "20231015010000_LFR_オードリーのオールナイトニッポン.chapters.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(chaptersRes), `"startTime": 6600`)
+	assert.Contains(t, string(chaptersRes), `"title": "東京ドームへの道"`)
+
+	t.Run("fetch all", func(t *testing.T) {
+		missing, err := ParseStationTime("LFR", "20231016010000", "")
+		require.NoError(t, err)
+		results, err := FetchAll(ctx, cnf, []Schedule{sche, missing, sche}, 2)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.Empty(t, results[0].Error)
+		assert.Equal(t, JobDone, results[0].Job.State)
+		assert.NotEmpty(t, results[1].Error)
+		assert.Equal(t, JobFailed, results[1].Job.State)
+		assert.Equal(t, results[0], results[2])
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		other, err := ParseStationTime("LFR", "20231017010000", "")
+		require.NoError(t, err)
+		results, err := FetchAll(canceledCtx, cnf, []Schedule{other}, 1)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, context.Canceled.Error(), results[0].Error)
+		// jobs not started are not left queued, to be resumed by the scheduler
+		store, err := OpenJobStore(JobStorePath(tempDir))
+		require.NoError(t, err)
+		jobs, err := store.Unfinished()
+		require.NoError(t, err)
+		assert.Empty(t, jobs)
+	})
+}
+
+func TestTimeshiftPlaylistURL(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	// the first hour of the program
+	httpmock.RegisterResponder("POST",
+		"https://radiko.jp/v2/api/ts/playlist.m3u8?ft=20231015010000&l=15&station_id=LFR&to=20231015020000",
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/uri.m3u8")))
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+	start := time.Date(2023, 10, 15, 1, 0, 0, 0, JST)
+	s := Schedule{StationID: LFR, StartTime: start, Duration: time.Hour}
+	end, err := s.endTime(&goradiko.Prog{Ft: "20231015010000", To: "20231015030000"})
+	require.NoError(t, err)
+	uri, err := timeshiftPlaylistURL(context.Background(), radikoClient, "zsxMY0BGnwAuRpbelwK-JA", s.StationID, s.StartTime, end)
+	require.NoError(t, err)
+	assert.Equal(t, "https://radiko.jp/v2/api/ts/chunklist/v1cA1fcZ.m3u8", uri)
+}
+
+func TestParseStationTime(t *testing.T) {
+	for _, start := range []string{"20231015010000", "202310150100", "2023-10-15 01:00", "2023-10-15T01:00"} {
+		s, err := ParseStationTime("LFR", start, "")
+		require.NoError(t, err, start)
+		assert.Equal(t, LFR, s.StationID)
+		assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), s.StartTime)
+		assert.Zero(t, s.Duration)
+	}
+	_, err := ParseStationTime("LFR", "tomorrow", "")
+	assert.Error(t, err)
+
+	s, err := ParseStationTime("LFR", "20231015010000", "2023-10-15 02:30")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, s.Duration)
+	_, err = ParseStationTime("LFR", "20231015010000", "20231015010000")
+	assert.Error(t, err)
+}
+
+func TestParseURL(t *testing.T) {
+	for _, u := range []string{
+		"https://radiko.jp/#!/ts/LFR/20231015010000",
+		"https://radiko.jp/#!/ts/LFR/20231015010000?utm_source=share",
+		"https://radiko.jp/share/?sid=LFR&t=20231015010000",
+		"https://radiko.jp/share/?noreload=1&t=20231015010000&sid=LFR",
+	} {
+		s, err := ParseURL(u)
+		require.NoError(t, err, u)
+		assert.Equal(t, LFR, s.StationID, u)
+		assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), s.StartTime, u)
+	}
+	s, err := ParseURL("https://radiko.jp/#!/ts/RN1/20231015010000")
+	require.NoError(t, err)
+	assert.Equal(t, StationID("RN1"), s.StationID)
+	_, err = ParseURL("https://radiko.jp/#!/live/LFR")
+	assert.Error(t, err)
+
+	s, err = ParseTarget([]string{"LFR", "20231015010000", "20231015020000"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, s.Duration)
+	_, err = ParseTarget([]string{"LFR"})
+	assert.Error(t, err)
+
+	for _, line := range []string{
+		"LFR 20231015010000 20231015020000",
+		"LFR,2023-10-15 01:00,2023-10-15 02:00",
+		"LFR\t2023-10-15 01:00\t2023-10-15T02:00",
+		"LFR, 2023-10-15 01:00, 20231015020000",
+	} {
+		s, err := ParseTargetLine(line)
+		require.NoError(t, err, line)
+		assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), s.StartTime, line)
+		assert.Equal(t, time.Hour, s.Duration, line)
+	}
+	s, err = ParseTargetLine("https://radiko.jp/#!/ts/LFR/20231015010000")
+	require.NoError(t, err)
+	assert.Equal(t, LFR, s.StationID)
+	// times with spaces need separators
+	_, err = ParseTargetLine("LFR 2023-10-15 01:00")
+	assert.Error(t, err)
 }
@@ -0,0 +1,138 @@
+package radiko
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+// episodeTags returns tags of the program with the cover art of the rule or the program.
+// The cover is optional, so failures to get it are only logged.
+func episodeTags(ctx context.Context, logger *slog.Logger, s Schedule, pg *goradiko.Prog, meta programMeta, httpClient *http.Client) audio.Tags {
+	tags := audio.Tags{
+		Title:   pg.Title,
+		Artist:  pg.Pfm,
+		Album:   string(s.StationID),
+		Date:    s.StartTime.In(JST).Format("2006-01-02T15:04"),
+		Comment: plainText(pg.Desc),
+	}
+	if end, err := s.endTime(pg); err == nil {
+		tags.Duration = end.Sub(s.StartTime)
+		tags.Chapters = parseChapters(tags.Comment, s.StartTime, tags.Duration)
+	}
+	if meta.StationName != "" {
+		tags.Album = meta.StationName
+	}
+	image := s.Image
+	if image == "" {
+		image = meta.ImageURL
+	}
+	if image == "" {
+		return tags
+	}
+	cover, err := loadImage(ctx, httpClient, image)
+	if err != nil {
+		logger.Warn("failed to load cover art", "image", image, "error", err)
+		return tags
+	}
+	tags.Cover = cover
+	tags.CoverMIME = http.DetectContentType(cover)
+	return tags
+}
+
+const maxImageSize = 10 << 20
+
+// loadImage downloads the image if it is a URL, or reads it from the file.
+func loadImage(ctx context.Context, httpClient *http.Client, image string) ([]byte, error) {
+	if !strings.HasPrefix(image, "http://") && !strings.HasPrefix(image, "https://") {
+		return os.ReadFile(image)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, image, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxImageSize))
+}
+
+var (
+	brTagRegex   = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlTagRegex = regexp.MustCompile(`<[^>]*>`)
+)
+
+// plainText strips HTML tags of program descriptions.
+func plainText(s string) string {
+	s = brTagRegex.ReplaceAllString(s, "\n")
+	s = htmlTagRegex.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+var (
+	chapterMarkerRegex = regexp.MustCompile(`(?m)^\s*■\s*(\d{1,2}):(\d{2})(.*)$`)
+	// chapterRangeRegex matches the rest of the time range like "～1:35頃" or "頃～"
+	chapterRangeRegex = regexp.MustCompile(`^\s*頃?\s*[～〜~\-－]?\s*(\d{1,2}:\d{2})?\s*頃?\s*[～〜~]?`)
+)
+
+// parseChapters parses the timeline of the description like "■1:00～1:35頃" into chapters of the program started at start.
+// The title of a chapter follows the time on the same line, or is on the next line.
+func parseChapters(desc string, start time.Time, duration time.Duration) []audio.Chapter {
+	var chapters []audio.Chapter
+	for _, m := range chapterMarkerRegex.FindAllStringSubmatchIndex(desc, -1) {
+		hour, _ := strconv.Atoi(desc[m[2]:m[3]])
+		minute, _ := strconv.Atoi(desc[m[4]:m[5]])
+		clock := time.Date(start.Year(), start.Month(), start.Day(), hour, minute, 0, 0, JST)
+		if hour >= 24 {
+			// late-night notation like "25:30" counts from the broadcast day, as StartHour of rules does
+			day := broadcastDay(start)
+			clock = time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, JST)
+		}
+		offset := clock.Sub(start)
+		if offset < -12*time.Hour {
+			// the marker is after midnight
+			offset += 24 * time.Hour
+		}
+		if offset < 0 || offset >= duration {
+			continue
+		}
+
+		title := strings.TrimSpace(chapterRangeRegex.ReplaceAllString(desc[m[6]:m[7]], ""))
+		if title == "" {
+			for _, line := range strings.Split(desc[m[1]:], "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "■") {
+					title = line
+					break
+				} else if line != "" {
+					break
+				}
+			}
+		}
+		if title == "" {
+			continue
+		}
+		if len(chapters) > 0 && chapters[len(chapters)-1].Start >= offset {
+			continue
+		}
+		chapters = append(chapters, audio.Chapter{Start: offset, Title: title})
+	}
+	return chapters
+}
@@ -0,0 +1,39 @@
+package radiko
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChapters(t *testing.T) {
+	start := time.Date(2023, 10, 15, 1, 0, 0, 0, JST)
+	desc := plainText("オードリーの2人が土曜の夜にじっくりお話してます。<br><br>■1:00～1:35頃<br>オープニングトーク<br><br>■1:40～1:55頃<br>東京ドームへの道<br><br>■2:00頃～<br>若林フリートーク<br><br>■2:54頃～ エンディングトーク<br><br>■3:10頃～<br>次の番組")
+	assert.Equal(t, []audio.Chapter{
+		{Start: 0, Title: "オープニングトーク"},
+		{Start: 40 * time.Minute, Title: "東京ドームへの道"},
+		{Start: time.Hour, Title: "若林フリートーク"},
+		{Start: 114 * time.Minute, Title: "エンディングトーク"},
+	}, parseChapters(desc, start, 2*time.Hour))
+
+	t.Run("after midnight", func(t *testing.T) {
+		start := time.Date(2023, 10, 14, 23, 30, 0, 0, JST)
+		assert.Equal(t, []audio.Chapter{
+			{Start: 0, Title: "オープニング"},
+			{Start: 45 * time.Minute, Title: "コーナー"},
+		}, parseChapters("■23:30 オープニング\n■0:15 コーナー", start, time.Hour))
+	})
+
+	t.Run("late-night notation", func(t *testing.T) {
+		assert.Equal(t, []audio.Chapter{
+			{Start: 0, Title: "オープニング"},
+			{Start: 90 * time.Minute, Title: "エンディング"},
+		}, parseChapters("■25:00 オープニング\n■26:30 エンディング", start, 2*time.Hour))
+	})
+
+	t.Run("no timeline", func(t *testing.T) {
+		assert.Empty(t, parseChapters("■メッセージテーマ\n募集中", start, 2*time.Hour))
+	})
+}
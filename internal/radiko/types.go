@@ -1,11 +1,18 @@
 package radiko
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/robfig/cron/v3"
+	goradiko "github.com/yyoshiki41/go-radiko"
 )
 
 var JST = time.FixedZone("Asia/Tokyo", 9*60*60)
@@ -17,56 +24,254 @@ const (
 	LFR StationID = "LFR" // ニッポン放送
 )
 
-const (
-	offsetTime      = 6 * time.Hour
-	plannerInterval = 10 * time.Minute
-	fetchTimeout    = 3 * time.Minute
-)
+// timeshiftWindow is how long radiko keeps time-shifted audio after the broadcast.
+const timeshiftWindow = 7 * 24 * time.Hour
 
 type Rule struct {
-	Name        string
-	StationID   StationID
-	Weekday     time.Weekday
+	Name      string
+	StationID StationID
+	// Weekdays are of the day which StartHour counts from, like Saturday for 25:00 of Saturday.
+	Weekdays []time.Weekday
+	// StartHour may be 24 or later for programs after midnight, like 25 for 1:00 of the next day.
 	StartHour   int
 	StartMinute int
-	Duration    time.Duration
+	// Cron gives start times in JST instead of Weekdays, StartHour and StartMinute.
+	Cron cron.Schedule
+	// At is the start time of the one-shot rule, instead of Weekdays, StartHour and StartMinute.
+	At time.Time
+	// From and Until are the first and the last day of broadcasts of the rule, zero for no limit.
+	From  time.Time
+	Until time.Time
+	// ExcludeDates are days of broadcasts to skip.
+	ExcludeDates []time.Time
+	// Duration is of the recording from the start, trimming the program or spanning consecutive programs.
+	// Zero means until the end of the program.
+	Duration time.Duration
+	// OffsetTime is the time from the start of the program to fetch it.
+	OffsetTime time.Duration
+	// FetchTimeout is the timeout of fetching and converting the program.
+	FetchTimeout time.Duration
+	// Profile is the format of output audio files.
+	Profile audio.Profile
+	// Image is the URL or the file path of the cover art, overriding the program image.
+	Image string
+	// Live records the live stream from the start of the program, instead of the time-shifted audio.
+	Live bool
+	// Matcher is set for rules resolved against the program guide instead of a fixed weekday and start time.
+	Matcher *ProgramMatcher
+}
+
+func (r Rule) IsProgramRule() bool {
+	return r.Matcher != nil
+}
+
+// IsAreaRule reports whether the rule matches programs of every station in the area.
+func (r Rule) IsAreaRule() bool {
+	return r.IsProgramRule() && r.StationID == ""
 }
 
 func (r Rule) NextSchedules(n int) []Schedule {
 	if n <= 0 {
 		return []Schedule{}
 	}
-	schedules := make([]Schedule, n)
-	currentTime := time.Now().Add(-offsetTime)
-	for i := 0; i < n; i++ {
-		schedules[i] = r.nextSchedule(currentTime)
-		currentTime = schedules[i].StartTime
+	schedules := make([]Schedule, 0, n)
+	currentTime := time.Now().Add(-r.OffsetTime)
+	for len(schedules) < n {
+		s, ok := r.nextSchedule(currentTime)
+		if !ok {
+			break
+		}
+		schedules = append(schedules, s)
+		currentTime = s.StartTime
 	}
 	return schedules
 }
 
-func (r Rule) nextSchedule(t time.Time) Schedule {
-	dayAbs := t.Weekday() - r.Weekday
-	if dayAbs < 0 {
-		dayAbs += 7
+// nextSchedule returns the schedule of the first broadcast after t, or false if the rule has no more broadcasts.
+func (r Rule) nextSchedule(t time.Time) (Schedule, bool) {
+	startTime, ok := r.nextStartTime(t)
+	if !ok {
+		return Schedule{}, false
 	}
 	s := Schedule{
-		RuleName:  r.Name,
-		StationID: r.StationID,
-		StartTime: time.Date(t.Year(), t.Month(), t.Day()-int(dayAbs), r.StartHour, r.StartMinute, 0, 0, JST),
+		RuleName:     r.Name,
+		StationID:    r.StationID,
+		StartTime:    startTime,
+		FetchTimeout: r.FetchTimeout,
+		Profile:      r.Profile,
+		Image:        r.Image,
+		Live:         r.Live,
+		Duration:     r.Duration,
 	}
-	if s.StartTime.Before(t) || s.StartTime.Equal(t) {
-		s.StartTime = s.StartTime.AddDate(0, 0, 7)
+	s.FetchTime = s.StartTime.Add(r.OffsetTime)
+	return s, true
+}
+
+// nextStartTime returns the first start time after t within the validity of the rule.
+func (r Rule) nextStartTime(t time.Time) (time.Time, bool) {
+	// broadcasts before the first broadcast day start before it, and ones at 00:00 of the day are included
+	if t.Before(r.From) {
+		t = r.From.Add(-time.Nanosecond)
 	}
-	s.FetchTime = s.StartTime.Add(offsetTime)
-	return s
+	for {
+		startTime, ok := r.nextOccurrence(t)
+		if !ok || (!r.Until.IsZero() && r.day(startTime).After(r.Until)) {
+			return time.Time{}, false
+		}
+		if r.ActiveOn(startTime) {
+			return startTime, true
+		}
+		t = startTime
+	}
+}
+
+// nextOccurrence returns the first start time after t, ignoring the validity of the rule.
+func (r Rule) nextOccurrence(t time.Time) (time.Time, bool) {
+	t = t.In(JST)
+	if !r.At.IsZero() {
+		return r.At, r.At.After(t)
+	}
+	if r.Cron != nil {
+		next := r.Cron.Next(t)
+		return next, !next.IsZero()
+	}
+	if len(r.Weekdays) == 0 {
+		return time.Time{}, false
+	}
+	// start times after midnight like 25:00 belong to the previous broadcast day
+	for d := -(r.StartHour / 24) - 1; ; d++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+d, 0, 0, 0, 0, JST)
+		if !slices.Contains(r.Weekdays, day.Weekday()) {
+			continue
+		}
+		startTime := time.Date(day.Year(), day.Month(), day.Day(), r.StartHour, r.StartMinute, 0, 0, JST)
+		if startTime.After(t) {
+			return startTime, true
+		}
+	}
+}
+
+// ActiveOn reports whether the broadcast starting at startTime is within From and Until, and not excluded.
+func (r Rule) ActiveOn(startTime time.Time) bool {
+	day := r.day(startTime)
+	if !r.From.IsZero() && day.Before(r.From) {
+		return false
+	}
+	if !r.Until.IsZero() && day.After(r.Until) {
+		return false
+	}
+	return !slices.ContainsFunc(r.ExcludeDates, day.Equal)
+}
+
+// day returns the date of the broadcast starting at startTime, which From, Until and ExcludeDates are compared with.
+// It is the day of the weekday for weekday rules, so that "25:00" of Saturday is on Saturday and "01:00" of Sunday is on Sunday,
+// the calendar day for cron rules, and the broadcast day for the others.
+func (r Rule) day(startTime time.Time) time.Time {
+	t := startTime.In(JST)
+	switch {
+	case r.Cron != nil:
+	case len(r.Weekdays) > 0:
+		t = t.AddDate(0, 0, -(r.StartHour / 24))
+	default:
+		return broadcastDay(t)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, JST)
+}
+
+// broadcastDay returns the date of the broadcast day, which lasts until 29:00 as in radio listings.
+func broadcastDay(t time.Time) time.Time {
+	t = t.In(JST).Add(-(maxBroadcastHour - 24) * time.Hour)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, JST)
+}
+
+// ProgramSchedules returns schedules of the programs in guide which match the rule and start after t.
+// Area rules match programs of all stations in guide.
+func (r Rule) ProgramSchedules(guide ProgramGuide, t time.Time) []Schedule {
+	if r.Matcher == nil {
+		return []Schedule{}
+	}
+	stationIDs := []StationID{r.StationID}
+	if r.IsAreaRule() {
+		stationIDs = guide.stationIDs()
+	}
+	schedules := make([]Schedule, 0)
+	for _, stationID := range stationIDs {
+		for _, pg := range guide[stationID] {
+			if !r.Matcher.Match(pg) {
+				continue
+			}
+			startTime, err := parseProgTime(pg.Ft)
+			if err != nil {
+				continue
+			}
+			if startTime.Before(t) || startTime.Equal(t) || !r.ActiveOn(startTime) {
+				continue
+			}
+			schedules = append(schedules, Schedule{
+				RuleName:     r.Name,
+				StationID:    stationID,
+				StartTime:    startTime,
+				FetchTime:    startTime.Add(r.OffsetTime),
+				FetchTimeout: r.FetchTimeout,
+				Profile:      r.Profile,
+				Image:        r.Image,
+				Live:         r.Live,
+				Duration:     r.Duration,
+			})
+		}
+	}
+	return schedules
+}
+
+// PastSchedules returns schedules which started in [from, to), to be fetched at fetchTime.
+func (r Rule) PastSchedules(guide ProgramGuide, from, to, fetchTime time.Time) []Schedule {
+	var sches []Schedule
+	if r.IsProgramRule() {
+		sches = r.ProgramSchedules(guide, from.Add(-time.Nanosecond))
+	} else {
+		for s, ok := r.nextSchedule(from.Add(-time.Nanosecond)); ok && s.StartTime.Before(to); s, ok = r.nextSchedule(s.StartTime) {
+			sches = append(sches, s)
+		}
+	}
+	schedules := make([]Schedule, 0, len(sches))
+	for _, s := range sches {
+		if s.StartTime.Before(to) {
+			s.FetchTime = fetchTime
+			schedules = append(schedules, s)
+		}
+	}
+	return schedules
 }
 
 type Schedule struct {
-	RuleName  string
-	StationID StationID
-	StartTime time.Time
-	FetchTime time.Time
+	RuleName     string
+	StationID    StationID
+	StartTime    time.Time
+	FetchTime    time.Time
+	FetchTimeout time.Duration
+	Profile      audio.Profile
+	Image        string
+	Live         bool
+	// Duration is of the recording, zero until the end of the program.
+	Duration time.Duration
+}
+
+// endTime returns the end of the recording, which is the end of the program unless the duration is given.
+func (s Schedule) endTime(pg *goradiko.Prog) (time.Time, error) {
+	if s.Duration > 0 {
+		return s.StartTime.Add(s.Duration), nil
+	}
+	return parseProgTime(pg.To)
+}
+
+// ID identifies the broadcast of the schedule.
+func (s Schedule) ID() string {
+	return fmt.Sprintf("%s_%s", s.StationID, s.StartTime.In(JST).Format("20060102150405"))
+}
+
+// SameBroadcast reports whether both schedules point to the same broadcast.
+func (s Schedule) SameBroadcast(other Schedule) bool {
+	return s.StationID == other.StationID && s.StartTime.Equal(other.StartTime)
 }
 
 func (s Schedule) String() string {
@@ -79,63 +284,425 @@ func (s Schedule) String() string {
 	)
 }
 
-func loadRules(path string) ([]Rule, error) {
-	type tomlConfig struct {
-		Rules []struct {
-			Name      string `toml:"name"`
-			StationID string `toml:"station_id"`
-			Weekday   string `toml:"weekday"`
-			Start     string `toml:"start"`
-		} `toml:"rules"`
+// ruleConfig is a rule in rules.toml.
+type ruleConfig struct {
+	Name      string      `toml:"name"`
+	StationID string      `toml:"station_id"`
+	Weekday   weekdayList `toml:"weekday"`
+	Cron      string      `toml:"cron"`
+	At        string      `toml:"at"`
+	Start     string      `toml:"start"`
+	End       string      `toml:"end"`
+	Duration  string      `toml:"duration"`
+
+	From         string   `toml:"from"`
+	Until        string   `toml:"until"`
+	ExcludeDates []string `toml:"exclude_dates"`
+
+	OffsetTime   string `toml:"offset_time"`
+	FetchTimeout string `toml:"fetch_timeout"`
+	Format       string `toml:"format"`
+	Bitrate      string `toml:"bitrate"`
+	Image        string `toml:"image"`
+	Mode         string `toml:"mode"`
+
+	Title      string `toml:"title"`
+	TitleRegex string `toml:"title_regex"`
+	Pfm        string `toml:"pfm"`
+	PfmRegex   string `toml:"pfm_regex"`
+	Desc       string `toml:"desc"`
+	DescRegex  string `toml:"desc_regex"`
+}
+
+// decodeRules decodes rules.toml at path.
+func decodeRules(path string) ([]ruleConfig, toml.MetaData, error) {
+	var config struct {
+		Rules []ruleConfig `toml:"rules"`
 	}
-	var config tomlConfig
-	if _, err := toml.DecodeFile(path, &config); err != nil {
-		return nil, err
+	md, err := toml.DecodeFile(path, &config)
+	if err != nil {
+		return nil, md, err
 	}
+	return config.Rules, md, nil
+}
 
-	rules := make([]Rule, len(config.Rules))
-	for i, cRule := range config.Rules {
-		rules[i] = Rule{
-			Name:      cRule.Name,
-			StationID: StationID(cRule.StationID),
-		}
-		switch cRule.Weekday {
-		case "Sun":
-			rules[i].Weekday = time.Sunday
-		case "Mon":
-			rules[i].Weekday = time.Monday
-		case "Tue":
-			rules[i].Weekday = time.Tuesday
-		case "Wed":
-			rules[i].Weekday = time.Wednesday
-		case "Thu":
-			rules[i].Weekday = time.Thursday
-		case "Fri":
-			rules[i].Weekday = time.Friday
-		case "Sat":
-			rules[i].Weekday = time.Saturday
-		default:
-			return nil, fmt.Errorf("invalid weekday: %s", cRule.Weekday)
-		}
-		if _, err := fmt.Sscanf(cRule.Start, "%d:%d", &rules[i].StartHour, &rules[i].StartMinute); err != nil {
-			return nil, fmt.Errorf("invalid start time: %s", cRule.Start)
+// loadRules loads rules from path. Offset time, fetch timeout and output format not given by a rule are taken from cnf.
+func loadRules(path string, cnf *config.Config) ([]Rule, error) {
+	defaultProfile, err := outputProfile(cnf.Output.Format, cnf.Output.Bitrate, audio.Profile{Format: audio.AAC})
+	if err != nil {
+		return nil, err
+	}
+	cRules, _, err := decodeRules(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, len(cRules))
+	for i, cRule := range cRules {
+		if rules[i], err = newRule(cRule, cnf, defaultProfile); err != nil {
+			return nil, err
 		}
 	}
 	return rules, nil
 }
 
-func newSchedules(rules []Rule) []Schedule {
+// newRule builds the rule of cRule with defaults of cnf.
+func newRule(cRule ruleConfig, cnf *config.Config, defaultProfile audio.Profile) (Rule, error) {
+	rule := Rule{
+		Name:         cRule.Name,
+		StationID:    StationID(cRule.StationID),
+		OffsetTime:   cnf.Radiko.OffsetTime,
+		FetchTimeout: cnf.Radiko.FetchTimeout,
+		Image:        cRule.Image,
+	}
+	var err error
+	rule.Profile, err = outputProfile(cRule.Format, cRule.Bitrate, defaultProfile)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid rule %s: %w", cRule.Name, err)
+	}
+	if cRule.OffsetTime != "" {
+		offsetTime, err := time.ParseDuration(cRule.OffsetTime)
+		if err != nil || offsetTime < 0 {
+			return Rule{}, fmt.Errorf("invalid offset_time: %s", cRule.OffsetTime)
+		}
+		rule.OffsetTime = offsetTime
+	}
+	switch cRule.Mode {
+	case "", "timeshift":
+	case "live":
+		if cRule.OffsetTime != "" {
+			return Rule{}, fmt.Errorf("invalid rule %s: offset_time cannot be used with live mode", cRule.Name)
+		}
+		// live recording starts at the start of the program
+		rule.Live = true
+		rule.OffsetTime = 0
+	default:
+		return Rule{}, fmt.Errorf("invalid mode: %s", cRule.Mode)
+	}
+	if cRule.FetchTimeout != "" {
+		fetchTimeout, err := time.ParseDuration(cRule.FetchTimeout)
+		if err != nil || fetchTimeout <= 0 {
+			return Rule{}, fmt.Errorf("invalid fetch_timeout: %s", cRule.FetchTimeout)
+		}
+		rule.FetchTimeout = fetchTimeout
+	}
+	if cRule.End != "" && cRule.Duration != "" {
+		return Rule{}, fmt.Errorf("invalid rule %s: end and duration cannot be used together", cRule.Name)
+	}
+	if cRule.Duration != "" {
+		duration, err := time.ParseDuration(cRule.Duration)
+		if err != nil || duration <= 0 {
+			return Rule{}, fmt.Errorf("invalid duration: %s", cRule.Duration)
+		}
+		rule.Duration = duration
+		if err := rule.checkDuration(); err != nil {
+			return Rule{}, err
+		}
+	}
+	if cRule.From != "" {
+		if rule.From, err = time.ParseInLocation(time.DateOnly, cRule.From, JST); err != nil {
+			return Rule{}, fmt.Errorf("invalid from: %s", cRule.From)
+		}
+	}
+	if cRule.Until != "" {
+		if rule.Until, err = time.ParseInLocation(time.DateOnly, cRule.Until, JST); err != nil {
+			return Rule{}, fmt.Errorf("invalid until: %s", cRule.Until)
+		}
+	}
+	for _, date := range cRule.ExcludeDates {
+		d, err := time.ParseInLocation(time.DateOnly, date, JST)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid exclude_dates: %s", date)
+		}
+		rule.ExcludeDates = append(rule.ExcludeDates, d)
+	}
+	matcher, err := newProgramMatcher(
+		cRule.Title, cRule.TitleRegex,
+		cRule.Pfm, cRule.PfmRegex,
+		cRule.Desc, cRule.DescRegex,
+	)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid rule %s: %w", cRule.Name, err)
+	}
+	if matcher != nil {
+		if len(cRule.Weekday) > 0 || cRule.Cron != "" || cRule.At != "" || cRule.Start != "" || cRule.End != "" {
+			return Rule{}, fmt.Errorf("invalid rule %s: weekday, cron, at, start and end cannot be used with title, pfm or desc", cRule.Name)
+		}
+		rule.Matcher = matcher
+		return rule, nil
+	}
+	if rule.StationID == "" {
+		return Rule{}, fmt.Errorf("invalid rule %s: station_id is required without title, pfm or desc", cRule.Name)
+	}
+	if cRule.At != "" {
+		if len(cRule.Weekday) > 0 || cRule.Cron != "" || cRule.Start != "" || cRule.End != "" {
+			return Rule{}, fmt.Errorf("invalid rule %s: weekday, cron, start and end cannot be used with at", cRule.Name)
+		}
+		if rule.At, err = parseDateTime(cRule.At); err != nil {
+			return Rule{}, fmt.Errorf("invalid at: %s", cRule.At)
+		}
+		return rule, nil
+	}
+	if cRule.Cron != "" {
+		if len(cRule.Weekday) > 0 || cRule.Start != "" || cRule.End != "" {
+			return Rule{}, fmt.Errorf("invalid rule %s: weekday, start and end cannot be used with cron", cRule.Name)
+		}
+		sched, err := cron.ParseStandard(cRule.Cron)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid cron: %s: %w", cRule.Cron, err)
+		}
+		rule.Cron = sched
+		return rule, nil
+	}
+	if rule.Weekdays, err = parseWeekdays(cRule.Weekday); err != nil {
+		return Rule{}, err
+	}
+	if rule.StartHour, rule.StartMinute, err = parseClock(cRule.Start); err != nil {
+		return Rule{}, fmt.Errorf("invalid start time: %s", cRule.Start)
+	}
+	if cRule.End != "" {
+		endHour, endMinute, err := parseClock(cRule.End)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid end time: %s", cRule.End)
+		}
+		// the end not after the start is on the next day
+		d := time.Duration(endHour-rule.StartHour)*time.Hour + time.Duration(endMinute-rule.StartMinute)*time.Minute
+		if d <= 0 {
+			d += 24 * time.Hour
+		}
+		rule.Duration = d
+		if err := rule.checkDuration(); err != nil {
+			return Rule{}, err
+		}
+	}
+	return rule, nil
+}
+
+// checkDuration checks that the recording has ended by the fetch time, offset_time after the start.
+func (r Rule) checkDuration() error {
+	if !r.Live && r.Duration > r.OffsetTime {
+		return fmt.Errorf("invalid rule %s: recording of %s is longer than offset_time %s, after which it is fetched", r.Name, r.Duration, r.OffsetTime)
+	}
+	return nil
+}
+
+// weekdayList is a weekday or a list of weekdays in rules.toml.
+type weekdayList []string
+
+func (l *weekdayList) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		*l = weekdayList{v}
+	case []any:
+		for _, e := range v {
+			name, ok := e.(string)
+			if !ok {
+				return fmt.Errorf("invalid weekday: %v", e)
+			}
+			*l = append(*l, name)
+		}
+	default:
+		return fmt.Errorf("invalid weekday: %v", v)
+	}
+	return nil
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+// parseWeekdays parses names like "Mon" into weekdays in order. "daily" means all weekdays.
+func parseWeekdays(names []string) ([]time.Weekday, error) {
+	if len(names) == 0 {
+		return nil, errors.New("invalid weekday: weekday is required")
+	}
+	var weekdays []time.Weekday
+	for _, name := range names {
+		if name == "daily" {
+			return []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}, nil
+		}
+		weekday, ok := weekdayNames[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday: %s", name)
+		}
+		if !slices.Contains(weekdays, weekday) {
+			weekdays = append(weekdays, weekday)
+		}
+	}
+	slices.Sort(weekdays)
+	return weekdays, nil
+}
+
+// maxBroadcastHour is the end of the broadcast day, as radio listings write 5:00 of the next day as 29:00.
+const maxBroadcastHour = 29
+
+// parseClock parses the time like "01:00" or "25:00", which is 1:00 of the next day.
+func parseClock(s string) (int, int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil {
+		return 0, 0, err
+	}
+	if hour < 0 || hour > maxBroadcastHour || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("out of range: %s", s)
+	}
+	return hour, minute, nil
+}
+
+// parseDateTime parses the date and the time like "2023-10-14 25:00" in JST, which is 1:00 of the next day.
+func parseDateTime(s string) (time.Time, error) {
+	date, clock, ok := strings.Cut(s, " ")
+	if !ok {
+		return time.Time{}, fmt.Errorf("missing time: %s", s)
+	}
+	d, err := time.ParseInLocation(time.DateOnly, date, JST)
+	if err != nil {
+		return time.Time{}, err
+	}
+	hour, minute, err := parseClock(clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(d.Year(), d.Month(), d.Day(), hour, minute, 0, 0, JST), nil
+}
+
+// newProgramMatcher builds a ProgramMatcher from substrings and regular expressions.
+// It returns nil when no condition is given.
+func newProgramMatcher(title, titleRegex, pfm, pfmRegex, desc, descRegex string) (*ProgramMatcher, error) {
+	compile := func(name, sub, expr string) (*regexp.Regexp, error) {
+		switch {
+		case sub != "" && expr != "":
+			return nil, fmt.Errorf("%s and %s_regex cannot be used together", name, name)
+		case sub != "":
+			return regexp.MustCompile(regexp.QuoteMeta(sub)), nil
+		case expr != "":
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s_regex: %w", name, err)
+			}
+			return re, nil
+		}
+		return nil, nil
+	}
+	var (
+		m   ProgramMatcher
+		err error
+	)
+	if m.Title, err = compile("title", title, titleRegex); err != nil {
+		return nil, err
+	}
+	if m.Pfm, err = compile("pfm", pfm, pfmRegex); err != nil {
+		return nil, err
+	}
+	if m.Desc, err = compile("desc", desc, descRegex); err != nil {
+		return nil, err
+	}
+	if m.Title == nil && m.Pfm == nil && m.Desc == nil {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+// programStationIDs returns station IDs whose program guide is required by the rules, except area rules.
+func programStationIDs(rules []Rule) []StationID {
+	var stationIDs []StationID
+	for _, rule := range rules {
+		if rule.IsProgramRule() && !rule.IsAreaRule() && !slices.Contains(stationIDs, rule.StationID) {
+			stationIDs = append(stationIDs, rule.StationID)
+		}
+	}
+	return stationIDs
+}
+
+// hasAreaRule reports whether the program guide of the whole area is required by the rules.
+func hasAreaRule(rules []Rule) bool {
+	return slices.ContainsFunc(rules, Rule.IsAreaRule)
+}
+
+// newSchedules returns schedules of the rules sorted by fetch time.
+// A broadcast matched by several rules is scheduled only once, preferring weekday rules.
+func newSchedules(rules []Rule, guide ProgramGuide) []Schedule {
 	newSches := make([]Schedule, 0, 100)
+	now := time.Now()
 	for _, rule := range rules {
-		newSches = append(newSches, rule.NextSchedules(3)...)
+		if !rule.IsProgramRule() {
+			newSches = appendUniqueSchedules(newSches, rule.NextSchedules(3)...)
+		}
 	}
-	slices.SortFunc(newSches, func(a, b Schedule) int {
-		if a.StartTime.Before(b.StartTime) {
-			return -1
-		} else if a.StartTime.After(b.StartTime) {
-			return 1
+	for _, rule := range rules {
+		if rule.IsProgramRule() {
+			newSches = appendUniqueSchedules(newSches, rule.ProgramSchedules(guide, now.Add(-rule.OffsetTime))...)
 		}
-		return 0
-	})
+	}
+	sortSchedules(newSches)
 	return newSches
 }
+
+// pastSchedules returns schedules of the rules which started from from until their offset time before now,
+// to be fetched at now. Live rules are skipped, as past broadcasts cannot be recorded live.
+func pastSchedules(rules []Rule, guide ProgramGuide, from, now time.Time) []Schedule {
+	sches := make([]Schedule, 0)
+	for _, rule := range rules {
+		if !rule.IsProgramRule() && !rule.Live {
+			sches = appendUniqueSchedules(sches, rule.PastSchedules(guide, from, now.Add(-rule.OffsetTime), now)...)
+		}
+	}
+	for _, rule := range rules {
+		if rule.IsProgramRule() && !rule.Live {
+			sches = appendUniqueSchedules(sches, rule.PastSchedules(guide, from, now.Add(-rule.OffsetTime), now)...)
+		}
+	}
+	sortSchedules(sches)
+	return sches
+}
+
+// sortSchedules sorts schedules by fetch time, and by start time for the same fetch time.
+func sortSchedules(sches []Schedule) {
+	slices.SortFunc(sches, func(a, b Schedule) int {
+		if c := a.FetchTime.Compare(b.FetchTime); c != 0 {
+			return c
+		}
+		return a.StartTime.Compare(b.StartTime)
+	})
+}
+
+// maxOffsetTime returns the longest offset time of the rules.
+func maxOffsetTime(rules []Rule) time.Duration {
+	var d time.Duration
+	for _, rule := range rules {
+		d = max(d, rule.OffsetTime)
+	}
+	return d
+}
+
+// outputProfile returns the profile of format and bitrate, which default to def when empty.
+func outputProfile(format, bitrate string, def audio.Profile) (audio.Profile, error) {
+	p := def
+	if format != "" {
+		f, err := audio.ParseFormat(format)
+		if err != nil {
+			return audio.Profile{}, err
+		}
+		if f != def.Format {
+			p = audio.Profile{Format: f}
+		}
+	}
+	if bitrate != "" {
+		p.Bitrate = bitrate
+	}
+	return p, nil
+}
+
+// appendUniqueSchedules appends schedules whose station and start time are not in sches yet.
+func appendUniqueSchedules(sches []Schedule, newSches ...Schedule) []Schedule {
+	for _, newSche := range newSches {
+		if !slices.ContainsFunc(sches, newSche.SameBroadcast) {
+			sches = append(sches, newSche)
+		}
+	}
+	return sches
+}
@@ -0,0 +1,593 @@
+package radiko
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abekoh/radiko-archiver/internal/audio"
+	"github.com/abekoh/radiko-archiver/internal/config"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	goradiko "github.com/yyoshiki41/go-radiko"
+)
+
+func writeRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.toml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadRules(t *testing.T) {
+	rules, err := loadRules(writeRules(t, `
+[[rules]]
+name = "オードリーのオールナイトニッポン"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+
+[[rules]]
+name = "オールナイトニッポン"
+station_id = "LFR"
+title = "オールナイトニッポン"
+pfm_regex = "^オードリー"
+offset_time = "3h"
+fetch_timeout = "10m"
+format = "mp3"
+`), &config.Config{
+		Radiko: config.Radiko{OffsetTime: 6 * time.Hour, FetchTimeout: 3 * time.Minute},
+		Output: config.Output{Format: "m4a"},
+	})
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.False(t, rules[0].IsProgramRule())
+	assert.Equal(t, []time.Weekday{time.Sunday}, rules[0].Weekdays)
+	assert.Equal(t, 6*time.Hour, rules[0].OffsetTime)
+	assert.Equal(t, 3*time.Minute, rules[0].FetchTimeout)
+	assert.Equal(t, audio.Profile{Format: audio.M4A}, rules[0].Profile)
+	assert.True(t, rules[1].IsProgramRule())
+	assert.NotNil(t, rules[1].Matcher.Title)
+	assert.NotNil(t, rules[1].Matcher.Pfm)
+	assert.Nil(t, rules[1].Matcher.Desc)
+	assert.Equal(t, 3*time.Hour, rules[1].OffsetTime)
+	assert.Equal(t, 10*time.Minute, rules[1].FetchTimeout)
+	assert.Equal(t, audio.Profile{Format: audio.MP3}, rules[1].Profile)
+
+	// zero in config.toml is kept
+	cnf := config.Default()
+	cnf.Radiko.OffsetTime = 0
+	rules, err = loadRules(writeRules(t, `
+[[rules]]
+name = "オードリーのオールナイトニッポン"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+`), cnf)
+	require.NoError(t, err)
+	assert.Zero(t, rules[0].OffsetTime)
+	rules, err = loadRules(writeRules(t, `
+[[rules]]
+name = "オードリーのオールナイトニッポン"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+`), config.Default())
+	require.NoError(t, err)
+	assert.Equal(t, 6*time.Hour, rules[0].OffsetTime)
+
+	_, err = loadRules(writeRules(t, `
+[[rules]]
+name = "invalid"
+station_id = "LFR"
+title = "オールナイトニッポン"
+weekday = "Sun"
+start = "01:00"
+`), config.Default())
+	assert.Error(t, err)
+
+	_, err = loadRules(writeRules(t, `
+[[rules]]
+name = "invalid"
+station_id = "LFR"
+title_regex = "("
+`), config.Default())
+	assert.Error(t, err)
+
+	_, err = loadRules(writeRules(t, `
+[[rules]]
+name = "invalid"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+format = "wav"
+`), config.Default())
+	assert.Error(t, err)
+
+	rules, err = loadRules(writeRules(t, `
+[[rules]]
+name = "first hour"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+end = "02:00"
+
+[[rules]]
+name = "across midnight"
+station_id = "TBS"
+weekday = "Sat"
+start = "23:00"
+end = "01:00"
+
+[[rules]]
+name = "program"
+station_id = "LFR"
+title = "オールナイトニッポン"
+duration = "1h30m"
+`), config.Default())
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	assert.Equal(t, time.Hour, rules[0].Duration)
+	assert.Equal(t, 2*time.Hour, rules[1].Duration)
+	assert.Equal(t, 90*time.Minute, rules[2].Duration)
+	assert.Equal(t, time.Hour, rules[0].NextSchedules(1)[0].Duration)
+
+	for _, rule := range []string{`
+[[rules]]
+name = "invalid"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+end = "02:00"
+duration = "1h"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "LFR"
+title = "オールナイトニッポン"
+end = "02:00"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+duration = "-1h"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "LFR"
+weekday = "Sat"
+start = "23:00"
+end = "05:00"
+offset_time = "4h"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "LFR"
+title = "オールナイトニッポン"
+duration = "7h"
+`} {
+		_, err = loadRules(writeRules(t, rule), config.Default())
+		assert.Error(t, err)
+	}
+
+	rules, err = loadRules(writeRules(t, `
+[[rules]]
+name = "ラジオ生放送"
+station_id = "TBS"
+weekday = "Mon"
+start = "13:00"
+mode = "live"
+`), config.Default())
+	require.NoError(t, err)
+	assert.True(t, rules[0].Live)
+	assert.Zero(t, rules[0].OffsetTime)
+	sche := rules[0].NextSchedules(1)[0]
+	assert.True(t, sche.Live)
+	assert.Equal(t, sche.StartTime, sche.FetchTime)
+	assert.Empty(t, pastSchedules(rules, nil, time.Now().Add(-timeshiftWindow), time.Now()))
+
+	_, err = loadRules(writeRules(t, `
+[[rules]]
+name = "invalid"
+station_id = "TBS"
+weekday = "Mon"
+start = "13:00"
+mode = "live"
+offset_time = "1h"
+`), config.Default())
+	assert.Error(t, err)
+}
+
+func TestRule_ProgramSchedules(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/program/station/weekly/LFR.xml",
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+	guide, err := fetchProgramGuide(context.Background(), radikoClient, []StationID{LFR})
+	require.NoError(t, err)
+	require.NotEmpty(t, guide[LFR])
+
+	matcher, err := newProgramMatcher("オールナイトニッポン", "", "", "^オードリー", "", "")
+	require.NoError(t, err)
+	rule := Rule{
+		Name:         "オードリー",
+		StationID:    LFR,
+		OffsetTime:   6 * time.Hour,
+		FetchTimeout: 3 * time.Minute,
+		Matcher:      matcher,
+	}
+	sches := rule.ProgramSchedules(guide, time.Date(2023, 10, 14, 5, 0, 0, 0, JST))
+	require.Len(t, sches, 1)
+	assert.Equal(t, Schedule{
+		RuleName:     "オードリー",
+		StationID:    LFR,
+		StartTime:    time.Date(2023, 10, 15, 1, 0, 0, 0, JST),
+		FetchTime:    time.Date(2023, 10, 15, 7, 0, 0, 0, JST),
+		FetchTimeout: 3 * time.Minute,
+	}, sches[0])
+
+	assert.Empty(t, rule.ProgramSchedules(guide, time.Date(2023, 10, 15, 1, 0, 0, 0, JST)))
+}
+
+func TestRule_ProgramSchedules_Area(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	httpmock.RegisterResponder("GET",
+		`=~^https:\/\/radiko\.jp\/v3\/program\/date\/[0-9]{8}\/JP13\.xml$`,
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+	from := time.Date(2023, 10, 14, 5, 0, 0, 0, JST)
+	guide, err := fetchAreaProgramGuide(context.Background(), radikoClient, from, from.AddDate(0, 0, guideDays-1))
+	require.NoError(t, err)
+	assert.Contains(t, guide.stationIDs(), TBS)
+	assert.Contains(t, guide.stationIDs(), LFR)
+
+	matcher, err := newProgramMatcher("", "", "オードリー", "", "", "")
+	require.NoError(t, err)
+	rule := Rule{
+		Name:       "オードリー",
+		OffsetTime: 6 * time.Hour,
+		Matcher:    matcher,
+	}
+	require.True(t, rule.IsAreaRule())
+	sches := rule.ProgramSchedules(guide, from)
+	stationIDs := make([]StationID, 0, len(sches))
+	for _, s := range sches {
+		stationIDs = append(stationIDs, s.StationID)
+	}
+	assert.Contains(t, stationIDs, LFR)
+	assert.Greater(t, len(sches), 1)
+
+	weekdaySche := Schedule{
+		RuleName:  "オードリーのオールナイトニッポン",
+		StationID: LFR,
+		StartTime: time.Date(2023, 10, 15, 1, 0, 0, 0, JST),
+		FetchTime: time.Date(2023, 10, 15, 7, 0, 0, 0, JST),
+	}
+	merged := appendUniqueSchedules([]Schedule{weekdaySche}, sches...)
+	assert.Len(t, merged, len(sches))
+	assert.Equal(t, weekdaySche, merged[0])
+}
+
+func TestRulesGuideCache(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	httpmock.RegisterResponder("GET",
+		`=~^https://radiko\.jp/v3/program/station/weekly/(LFR|TBS)\.xml$`,
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+	matcher, err := newProgramMatcher("オールナイトニッポン", "", "", "", "", "")
+	require.NoError(t, err)
+	rules := []Rule{{Name: "LFR", StationID: LFR, Matcher: matcher}}
+	now := time.Date(2023, 10, 14, 5, 0, 0, 0, JST)
+	var cache rulesGuideCache
+	get := func(rules []Rule, now time.Time) {
+		guide, err := cache.get(context.Background(), radikoClient, rules, now, now)
+		require.NoError(t, err)
+		require.NotEmpty(t, guide)
+	}
+
+	const lfrKey = "GET https://radiko.jp/v3/program/station/weekly/LFR.xml"
+	get(rules, now)
+	get(rules, now.Add(10*time.Minute))
+	assert.Equal(t, 1, httpmock.GetCallCountInfo()[lfrKey])
+
+	// stations of the rules changed
+	rules = append(rules, Rule{Name: "TBS", StationID: TBS, Matcher: matcher})
+	now = now.Add(20 * time.Minute)
+	get(rules, now)
+	assert.Equal(t, 2, httpmock.GetCallCountInfo()[lfrKey])
+
+	get(rules, now.Add(guideRefreshInterval-time.Minute))
+	assert.Equal(t, 2, httpmock.GetCallCountInfo()[lfrKey])
+	// a day later
+	get(rules, now.Add(guideRefreshInterval))
+	assert.Equal(t, 3, httpmock.GetCallCountInfo()[lfrKey])
+}
+
+func TestFetchProgram(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	registerAreaResponder()
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/program/date/20231014/JP13.xml",
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+
+	radikoClient, err := goradiko.New("")
+	require.NoError(t, err)
+	startTime := time.Date(2023, 10, 15, 1, 0, 0, 0, JST)
+
+	pg, meta, err := fetchProgram(context.Background(), radikoClient, "JP13", Schedule{StationID: LFR, StartTime: startTime})
+	require.NoError(t, err)
+	assert.Equal(t, "オードリーのオールナイトニッポン", pg.Title)
+	assert.Equal(t, "ニッポン放送", meta.StationName)
+	assert.Equal(t, "https://radiko.jp/res/program/DEFAULT_IMAGE/LFR/40zg3cgaf8.jpg", meta.ImageURL)
+
+	// the program on air
+	pg, _, err = fetchProgram(context.Background(), radikoClient, "JP13", Schedule{StationID: LFR, StartTime: startTime.Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Equal(t, "20231015010000", pg.Ft)
+
+	_, _, err = fetchProgram(context.Background(), radikoClient, "JP13", Schedule{StationID: "ABC", StartTime: startTime})
+	assert.ErrorIs(t, err, errStationNotAvailable)
+	assert.EqualError(t, err, "station not available in area: ABC is not in JP13")
+
+	// area-free
+	httpmock.RegisterResponder("GET",
+		"https://radiko.jp/v3/program/station/date/20231014/LFR.xml",
+		httpmock.NewXmlResponderOrPanic(http.StatusOK, httpmock.File("testdata/JP13.xml")))
+	pg, _, err = fetchProgram(context.Background(), radikoClient, "", Schedule{StationID: LFR, StartTime: startTime})
+	require.NoError(t, err)
+	assert.Equal(t, "オードリーのオールナイトニッポン", pg.Title)
+}
+
+func TestRule_NextSchedules(t *testing.T) {
+	rules, err := loadRules(writeRules(t, `
+[[rules]]
+name = "weekdays"
+station_id = "TBS"
+weekday = ["Mon", "Tue", "Wed", "Thu", "Fri"]
+start = "13:00"
+
+[[rules]]
+name = "daily"
+station_id = "TBS"
+weekday = "daily"
+start = "05:00"
+
+[[rules]]
+name = "late night"
+station_id = "LFR"
+weekday = "Sat"
+start = "25:00"
+end = "27:00"
+
+[[rules]]
+name = "cron"
+station_id = "LFR"
+cron = "30 9 * * 1,3"
+duration = "30m"
+`), config.Default())
+	require.NoError(t, err)
+	require.Len(t, rules, 4)
+
+	// Friday
+	now := time.Date(2023, 10, 13, 12, 0, 0, 0, JST)
+	startTimes := func(rule Rule, n int) []time.Time {
+		var ts []time.Time
+		for s, ok := rule.nextSchedule(now); ok && len(ts) < n; s, ok = rule.nextSchedule(s.StartTime) {
+			ts = append(ts, s.StartTime)
+		}
+		return ts
+	}
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 10, 13, 13, 0, 0, 0, JST),
+		time.Date(2023, 10, 16, 13, 0, 0, 0, JST),
+		time.Date(2023, 10, 17, 13, 0, 0, 0, JST),
+	}, startTimes(rules[0], 3))
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 10, 14, 5, 0, 0, 0, JST),
+		time.Date(2023, 10, 15, 5, 0, 0, 0, JST),
+	}, startTimes(rules[1], 2))
+	// 25:00 of Saturday is 1:00 of Sunday
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 10, 15, 1, 0, 0, 0, JST),
+		time.Date(2023, 10, 22, 1, 0, 0, 0, JST),
+	}, startTimes(rules[2], 2))
+	assert.Equal(t, 2*time.Hour, rules[2].Duration)
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 10, 16, 9, 30, 0, 0, JST),
+		time.Date(2023, 10, 18, 9, 30, 0, 0, JST),
+	}, startTimes(rules[3], 2))
+
+	// on air after midnight of Saturday
+	now = time.Date(2023, 10, 15, 0, 30, 0, 0, JST)
+	s, ok := rules[2].nextSchedule(now)
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), s.StartTime)
+
+	for _, rule := range []string{`
+[[rules]]
+name = "invalid"
+station_id = "TBS"
+weekday = ["Mon", "Wedn"]
+start = "13:00"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "TBS"
+weekday = "Mon"
+start = "30:00"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "TBS"
+cron = "0 13 * *"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "TBS"
+cron = "0 13 * * *"
+weekday = "Mon"
+`} {
+		_, err = loadRules(writeRules(t, rule), config.Default())
+		assert.Error(t, err)
+	}
+}
+
+func TestRule_Validity(t *testing.T) {
+	rules, err := loadRules(writeRules(t, `
+[[rules]]
+name = "final season"
+station_id = "LFR"
+weekday = "Sat"
+start = "25:00"
+from = "2023-10-07"
+until = "2023-10-28"
+exclude_dates = ["2023-10-14"]
+
+[[rules]]
+name = "special"
+station_id = "TBS"
+at = "2023-10-14 25:30"
+duration = "1h"
+
+[[rules]]
+name = "special series"
+station_id = "LFR"
+title = "オールナイトニッポン"
+until = "2023-10-13"
+`), config.Default())
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, JST)
+	var startTimes []time.Time
+	for s, ok := rules[0].nextSchedule(now); ok; s, ok = rules[0].nextSchedule(s.StartTime) {
+		startTimes = append(startTimes, s.StartTime)
+	}
+	// broadcast days are of 25:00, the day before the start time
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 10, 8, 1, 0, 0, 0, JST),
+		time.Date(2023, 10, 22, 1, 0, 0, 0, JST),
+		time.Date(2023, 10, 29, 1, 0, 0, 0, JST),
+	}, startTimes)
+
+	// days are of the weekday, the same day as the start time before 24:00
+	sunday, err := loadRules(writeRules(t, `
+[[rules]]
+name = "final season"
+station_id = "LFR"
+weekday = "Sun"
+start = "01:00"
+from = "2023-10-08"
+until = "2023-10-29"
+exclude_dates = ["2023-10-15"]
+`), config.Default())
+	require.NoError(t, err)
+	startTimes = nil
+	for s, ok := sunday[0].nextSchedule(now); ok; s, ok = sunday[0].nextSchedule(s.StartTime) {
+		startTimes = append(startTimes, s.StartTime)
+	}
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 10, 8, 1, 0, 0, 0, JST),
+		time.Date(2023, 10, 22, 1, 0, 0, 0, JST),
+		time.Date(2023, 10, 29, 1, 0, 0, 0, JST),
+	}, startTimes)
+
+	// broadcasts at 00:00 of the first day are included
+	midnight, err := loadRules(writeRules(t, `
+[[rules]]
+name = "new season"
+station_id = "TBS"
+weekday = "Fri"
+start = "00:00"
+from = "2023-10-20"
+`), config.Default())
+	require.NoError(t, err)
+	s, ok := midnight[0].nextSchedule(now)
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2023, 10, 20, 0, 0, 0, 0, JST), s.StartTime)
+
+	s, ok = rules[1].nextSchedule(now)
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2023, 10, 15, 1, 30, 0, 0, JST), s.StartTime)
+	assert.Equal(t, time.Hour, s.Duration)
+	_, ok = rules[1].nextSchedule(s.StartTime)
+	assert.False(t, ok)
+
+	// ended rules have no schedules
+	assert.Empty(t, rules[0].NextSchedules(3))
+	assert.Empty(t, rules[1].NextSchedules(3))
+	guide := ProgramGuide{LFR: {{Ft: "20231015010000", To: "20231015030000", Title: "オードリーのオールナイトニッポン"}}}
+	assert.Empty(t, rules[2].ProgramSchedules(guide, now))
+
+	for _, rule := range []string{`
+[[rules]]
+name = "invalid"
+station_id = "TBS"
+at = "2023-10-14"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "TBS"
+at = "2023-10-14 25:30"
+weekday = "Sat"
+`, `
+[[rules]]
+name = "invalid"
+station_id = "TBS"
+weekday = "Sat"
+start = "25:00"
+exclude_dates = ["10/14"]
+`} {
+		_, err = loadRules(writeRules(t, rule), config.Default())
+		assert.Error(t, err)
+	}
+}
+
+func TestRule_PastSchedules(t *testing.T) {
+	rule := Rule{
+		Name:        "オードリーのオールナイトニッポン",
+		StationID:   LFR,
+		Weekdays:    []time.Weekday{time.Sunday},
+		StartHour:   1,
+		StartMinute: 0,
+		OffsetTime:  6 * time.Hour,
+	}
+	now := time.Date(2023, 10, 23, 12, 0, 0, 0, JST)
+	sches := rule.PastSchedules(nil, now.Add(-timeshiftWindow), now.Add(-rule.OffsetTime), now)
+	assert.Equal(t, []Schedule{
+		{
+			RuleName:  "オードリーのオールナイトニッポン",
+			StationID: LFR,
+			StartTime: time.Date(2023, 10, 22, 1, 0, 0, 0, JST),
+			FetchTime: now,
+		},
+	}, sches)
+
+	sches = rule.PastSchedules(nil, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), time.Date(2023, 10, 22, 1, 0, 0, 0, JST), now)
+	require.Len(t, sches, 1)
+	assert.Equal(t, time.Date(2023, 10, 15, 1, 0, 0, 0, JST), sches[0].StartTime)
+}